@@ -0,0 +1,85 @@
+package firestarter
+
+import (
+	"fmt"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// aggregate computes the aggregation over the documents.
+func aggregate(docs []*Document, aggregation *pb.StructuredAggregationQuery_Aggregation) (*pb.Value, error) {
+	switch op := aggregation.GetOperator().(type) {
+	case *pb.StructuredAggregationQuery_Aggregation_Count_:
+		count := int64(len(docs))
+		if upTo := op.Count.GetUpTo(); upTo != nil && upTo.GetValue() < count {
+			count = upTo.GetValue()
+		}
+		return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: count}}, nil
+	case *pb.StructuredAggregationQuery_Aggregation_Sum_:
+		return sumValues(docs, op.Sum.GetField().GetFieldPath()), nil
+	case *pb.StructuredAggregationQuery_Aggregation_Avg_:
+		return avgValues(docs, op.Avg.GetField().GetFieldPath()), nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "unsupported aggregation: %T", aggregation.GetOperator())
+}
+
+// aggregationAlias returns the alias of the aggregation, or the alias the
+// server assigns when the aggregation doesn't have one.
+func aggregationAlias(aggregation *pb.StructuredAggregationQuery_Aggregation, index int) string {
+	if aggregation.GetAlias() != "" {
+		return aggregation.GetAlias()
+	}
+	return fmt.Sprintf("field_%d", index+1)
+}
+
+// sumValues sums the numeric values of field, ignoring any other values. The
+// sum is an integer unless a value is a double or the sum overflows.
+func sumValues(docs []*Document, field string) *pb.Value {
+	var intSum int64
+	var doubleSum float64
+	double := false
+	for _, doc := range docs {
+		switch v := doc.Get(field).(type) {
+		case int64:
+			sum := intSum + v
+			if (v > 0 && sum < intSum) || (v < 0 && sum > intSum) {
+				// integer overflow, continue as a double
+				double = true
+				doubleSum += float64(intSum) + float64(v)
+				intSum = 0
+			} else {
+				intSum = sum
+			}
+		case float64:
+			double = true
+			doubleSum += v
+		}
+	}
+
+	if double {
+		return &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: doubleSum + float64(intSum)}}
+	}
+	return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: intSum}}
+}
+
+// avgValues averages the numeric values of field, ignoring any other values.
+// The average is always a double, or null when there are no numeric values.
+func avgValues(docs []*Document, field string) *pb.Value {
+	sum := 0.0
+	count := 0
+	for _, doc := range docs {
+		value := doc.Get(field)
+		if isNumber(value) {
+			sum += numberAsFloat64(value)
+			count++
+		}
+	}
+
+	if count == 0 {
+		return &pb.Value{ValueType: &pb.Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}}
+	}
+	return &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: sum / float64(count)}}
+}
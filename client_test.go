@@ -2,13 +2,23 @@ package firestarter
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/type/latlng"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func TestClientDocGet(t *testing.T) {
@@ -1126,3 +1136,2064 @@ func TestClientUpdate(t *testing.T) {
 	assert.Equal(t, "value-1-1-1", docData["field1"])
 	assert.Equal(t, "new-value-1-1-2", docData["field2"])
 }
+
+func TestClientRunTransaction(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// read and write within a transaction
+	docRef := client.Doc("collection-1/document-1-1")
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docSnap, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		docSnaps, err := tx.Documents(client.Collection("collection-1").Where("field4", "==", "equal")).GetAll()
+		if err != nil {
+			return err
+		}
+		return tx.Set(docRef, map[string]interface{}{
+			"field1": docSnap.Data()["field1"].(string) + "-updated",
+			"field2": float64(len(docSnaps)),
+		})
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, srv.transactions)
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+
+	docData := docSnap.Data()
+	assert.Equal(t, "value-1-1-1-updated", docData["field1"])
+	assert.Equal(t, 2.0, docData["field2"])
+
+	// read only transaction
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docSnap, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, "value-1-1-1-updated", docSnap.Data()["field1"])
+		return nil
+	}, firestore.ReadOnly)
+	assert.Nil(t, err)
+	assert.Empty(t, srv.transactions)
+}
+
+func TestClientRunTransaction_rollback(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	docRef := client.Doc("collection-1/document-1-1")
+	txErr := errors.New("transaction failed")
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		err := tx.Set(docRef, map[string]interface{}{
+			"field1": "new-value-1-1-1",
+		})
+		if err != nil {
+			return err
+		}
+		return txErr
+	})
+	assert.Equal(t, txErr, err)
+	assert.Empty(t, srv.transactions)
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "value-1-1-1", docSnap.Data()["field1"])
+}
+
+func TestClientRunTransaction_conflict(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// modify a document read by the transaction before it commits
+	docRef := client.Doc("collection-1/document-1-1")
+	attempts := 0
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		attempts++
+		docSnap, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		if attempts == 1 {
+			_, err = docRef.Set(ctx, map[string]interface{}{
+				"field1": "concurrent-value",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Set(docRef, map[string]interface{}{
+			"field1": docSnap.Data()["field1"].(string) + "-updated",
+		})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "concurrent-value-updated", docSnap.Data()["field1"])
+
+	// reloading a document read by the transaction is a conflict
+	docRef = client.Doc("collection-1/document-1-2")
+	attempts = 0
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		attempts++
+		_, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		if attempts == 1 {
+			err = srv.LoadFromJSONFile("test.json")
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Set(docRef, map[string]interface{}{
+			"field1": "transaction-value",
+		})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// a missing document created by another commit is also a conflict
+	docRef = client.Doc("collection-1/document-xxxxx")
+	attempts = 0
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		attempts++
+		_, err := tx.Get(docRef)
+		if status.Code(err) != codes.NotFound {
+			return err
+		}
+		if attempts == 1 {
+			_, err = docRef.Set(ctx, map[string]interface{}{
+				"field1": "concurrent-value",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, firestore.MaxAttempts(1))
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Equal(t, 1, attempts)
+	assert.Empty(t, srv.transactions)
+}
+
+func TestClientRunTransaction_readOnly(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// read-only transactions don't conflict with writes to the documents they
+	// read
+	docRef := client.Doc("collection-1/document-1-1")
+	attempts := 0
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		attempts++
+		_, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		_, err = docRef.Set(ctx, map[string]interface{}{
+			"field1": "concurrent-value",
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tx.Documents(client.Collection("collection-1")).GetAll()
+		return err
+	}, firestore.ReadOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.Empty(t, srv.transactions)
+}
+
+func TestClientRunTransaction_concurrent(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	docRef := client.Doc("collection-1/counter")
+	_, err = docRef.Set(ctx, map[string]interface{}{
+		"count": 0.0,
+	})
+	assert.Nil(t, err)
+
+	const workers = 3
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errs <- client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+				docSnap, err := tx.Get(docRef)
+				if err != nil {
+					return err
+				}
+				return tx.Set(docRef, map[string]interface{}{
+					"count": docSnap.Data()["count"].(float64) + 1,
+				})
+			}, firestore.MaxAttempts(10))
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		assert.Nil(t, <-errs)
+	}
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(workers), docSnap.Data()["count"])
+}
+
+func TestClientDelete(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// delete a document
+	docRef := client.Doc("collection-1/document-1-1")
+	_, err = docRef.Delete(ctx)
+	assert.Nil(t, err)
+
+	_, err = docRef.Get(ctx)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	docSnaps, err := client.Collection("collection-1").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 1)
+	assert.Equal(t, "document-1-2", docSnaps[0].Ref.ID)
+
+	// deleting a missing document succeeds
+	_, err = docRef.Delete(ctx)
+	assert.Nil(t, err)
+
+	// unless it is required to exist
+	_, err = docRef.Delete(ctx, firestore.Exists)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// deleting a document leaves its subcollections
+	docRef = client.Doc("collection-2/document-2-4")
+	_, err = docRef.Delete(ctx)
+	assert.Nil(t, err)
+
+	_, err = docRef.Get(ctx)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	docSnaps, err = client.Collection("collection-2").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 1)
+	assert.Equal(t, "document-2-3", docSnaps[0].Ref.ID)
+
+	docSnaps, err = docRef.Collection("subcollection-2-4").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+
+	// and the document can be recreated
+	_, err = docRef.Set(ctx, map[string]interface{}{
+		"field1": "new-value-2-4-1",
+	})
+	assert.Nil(t, err)
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"field1": "new-value-2-4-1"}, docSnap.Data())
+
+	docSnaps, err = docRef.Collection("subcollection-2-4").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+}
+
+func TestClientDelete_batch(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	batch := client.Batch()
+	batch.Delete(client.Doc("collection-2/document-2-4/subcollection-2-4/subdocument-2-4-1"))
+	batch.Delete(client.Doc("collection-2/document-2-4/subcollection-2-4/subdocument-2-4-2"))
+	batch.Delete(client.Doc("collection-2/document-2-4"))
+	_, err = batch.Commit(ctx)
+	assert.Nil(t, err)
+
+	// the emptied collections and documents are removed
+	assert.NotContains(t, srv.data["collection-2"].documents, "document-2-4")
+
+	// delete within a transaction
+	docRef := client.Doc("collection-1/document-1-1")
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		_, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		return tx.Delete(docRef)
+	})
+	assert.Nil(t, err)
+
+	_, err = docRef.Get(ctx)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientTransforms(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	docRef := client.Doc("collection-1/document-1-1")
+	wr, err := docRef.Update(ctx, []firestore.Update{
+		{Path: "field3", Value: firestore.Increment(1)},
+		{Path: "field6", Value: firestore.ArrayUnion(3.0, 4.0, 4.0)},
+		{Path: "field7.subfield3", Value: firestore.ServerTimestamp},
+		{Path: "field10", Value: firestore.Increment(2)},
+		{Path: "field11", Value: firestore.ArrayRemove("a")},
+	})
+	assert.Nil(t, err)
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+
+	docData := docSnap.Data()
+	assert.Equal(t, "value-1-1-1", docData["field1"])
+	assert.Equal(t, 114.0, docData["field3"]) // double + integer is a double
+	assert.Equal(t, []interface{}{1.0, 2.0, 3.0, 4.0}, docData["field6"])
+	assert.Equal(t, map[string]interface{}{
+		"subfield1": "subvalue-1-1-1-1",
+		"subfield2": "subvalue-1-1-1-2",
+		"subfield3": wr.UpdateTime,
+	}, docData["field7"])
+	assert.Equal(t, int64(2), docData["field10"]) // missing field is set to the operand
+	assert.Equal(t, []interface{}{}, docData["field11"])
+
+	_, err = docRef.Update(ctx, []firestore.Update{
+		{Path: "field6", Value: firestore.ArrayRemove(1.0, 3.0)},
+		{Path: "field10", Value: firestore.Increment(int64(math.MaxInt64))},
+		{Path: "field12", Value: firestore.FieldTransformMaximum(5)},
+	})
+	assert.Nil(t, err)
+
+	docSnap, err = docRef.Get(ctx)
+	assert.Nil(t, err)
+
+	docData = docSnap.Data()
+	assert.Equal(t, []interface{}{2.0, 4.0}, docData["field6"])
+	assert.Equal(t, int64(math.MaxInt64), docData["field10"]) // integers saturate
+	assert.Equal(t, int64(5), docData["field12"])
+
+	_, err = docRef.Update(ctx, []firestore.Update{
+		{Path: "field3", Value: firestore.FieldTransformMinimum(100)},
+		{Path: "field12", Value: firestore.FieldTransformMaximum(4.5)},
+	})
+	assert.Nil(t, err)
+
+	docSnap, err = docRef.Get(ctx)
+	assert.Nil(t, err)
+
+	docData = docSnap.Data()
+	assert.Equal(t, int64(100), docData["field3"])
+	assert.Equal(t, int64(5), docData["field12"])
+
+	// transforms with a merge set create the document
+	docRef = client.Doc("collection-1/document-xxxxx")
+	_, err = docRef.Set(ctx, map[string]interface{}{
+		"count": firestore.Increment(1.5),
+		"tags":  firestore.ArrayUnion("a", "b"),
+	}, firestore.MergeAll)
+	assert.Nil(t, err)
+
+	docSnap, err = docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"count": 1.5,
+		"tags":  []interface{}{"a", "b"},
+	}, docSnap.Data())
+}
+
+func TestClientUpdate_nested(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	docRef := client.Doc("collection-1/document-1-1")
+	_, err = docRef.Update(ctx, []firestore.Update{
+		{Path: "field7.subfield1", Value: "new-subvalue-1-1-1-1"},
+		{Path: "field7.subfield2", Value: firestore.Delete},
+		{FieldPath: firestore.FieldPath{"field-with.dot"}, Value: "dotted"},
+	})
+	assert.Nil(t, err)
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+
+	docData := docSnap.Data()
+	assert.Equal(t, map[string]interface{}{
+		"subfield1": "new-subvalue-1-1-1-1",
+	}, docData["field7"])
+	assert.Equal(t, "dotted", docData["field-with.dot"])
+}
+
+func TestClientDocGet_times(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// loaded documents have stable times
+	docRef := client.Doc("collection-1/document-1-1")
+	docSnap1, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+	docSnap2, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.False(t, docSnap1.CreateTime.IsZero())
+	assert.Equal(t, docSnap1.CreateTime, docSnap1.UpdateTime)
+	assert.Equal(t, docSnap1.CreateTime, docSnap2.CreateTime)
+	assert.Equal(t, docSnap1.UpdateTime, docSnap2.UpdateTime)
+
+	// an update changes the update time only
+	wr, err := docRef.Update(ctx, []firestore.Update{
+		{Path: "field2", Value: "new-value-1-1-2"},
+	})
+	assert.Nil(t, err)
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, docSnap1.CreateTime, docSnap.CreateTime)
+	assert.Equal(t, wr.UpdateTime, docSnap.UpdateTime)
+	assert.True(t, docSnap.UpdateTime.After(docSnap1.UpdateTime))
+
+	// queries return the same times
+	docSnaps, err := client.Collection("collection-1").Where("field2", "==", "new-value-1-1-2").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 1)
+	assert.Equal(t, docSnap.CreateTime, docSnaps[0].CreateTime)
+	assert.Equal(t, docSnap.UpdateTime, docSnaps[0].UpdateTime)
+
+	// a new document is created at the time of the write
+	docRef = client.Doc("collection-1/document-xxxxx")
+	wr, err = docRef.Create(ctx, map[string]interface{}{
+		"field1": "value",
+	})
+	assert.Nil(t, err)
+
+	docSnap, err = docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, wr.UpdateTime, docSnap.CreateTime)
+	assert.Equal(t, wr.UpdateTime, docSnap.UpdateTime)
+}
+
+func TestClientCreate(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// create an existing document
+	docRef := client.Doc("collection-1/document-1-1")
+	_, err = docRef.Create(ctx, map[string]interface{}{
+		"field1": "new-value-1-1-1",
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "value-1-1-1", docSnap.Data()["field1"])
+
+	// create a new document
+	docRef = client.Doc("collection-1/document-xxxxx")
+	_, err = docRef.Create(ctx, map[string]interface{}{
+		"field1": "new-value",
+	})
+	assert.Nil(t, err)
+
+	_, err = docRef.Create(ctx, map[string]interface{}{
+		"field1": "new-value",
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestClientPrecondition_updateTime(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	docRef := client.Doc("collection-1/document-1-1")
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+
+	// update with the current update time
+	wr, err := docRef.Update(ctx, []firestore.Update{
+		{Path: "field2", Value: "new-value-1-1-2"},
+	}, firestore.LastUpdateTime(docSnap.UpdateTime))
+	assert.Nil(t, err)
+
+	// update and delete with a stale update time
+	_, err = docRef.Update(ctx, []firestore.Update{
+		{Path: "field2", Value: "stale-value-1-1-2"},
+	}, firestore.LastUpdateTime(docSnap.UpdateTime))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = docRef.Delete(ctx, firestore.LastUpdateTime(docSnap.UpdateTime))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	docSnap, err = docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "new-value-1-1-2", docSnap.Data()["field2"])
+
+	// delete with the current update time
+	_, err = docRef.Delete(ctx, firestore.LastUpdateTime(wr.UpdateTime))
+	assert.Nil(t, err)
+
+	_, err = docRef.Get(ctx)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// a missing document never matches an update time
+	_, err = docRef.Delete(ctx, firestore.LastUpdateTime(wr.UpdateTime))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestClientBatch_atomic(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// a failed write leaves every document unchanged
+	batch := client.Batch()
+	batch.Set(client.Doc("collection-1/document-1-1"), map[string]interface{}{
+		"field1": "new-value-1-1-1",
+	})
+	batch.Delete(client.Doc("collection-1/document-1-2"))
+	batch.Create(client.Doc("collection-1/document-xxxxx"), map[string]interface{}{
+		"field1": "new-value",
+	})
+	batch.Update(client.Doc("collection-2/document-xxxxx"), []firestore.Update{
+		{Path: "field1", Value: "new-value"},
+	})
+	_, err = batch.Commit(ctx)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	docSnaps, err := client.Collection("collection-1").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+	assert.Equal(t, "value-1-1-1", docSnaps[0].Data()["field1"])
+	assert.Equal(t, "value-1-2-1", docSnaps[1].Data()["field1"])
+
+	// later writes in a batch see earlier writes to the same document
+	docRef := client.Doc("collection-1/document-xxxxx")
+	batch = client.Batch()
+	batch.Create(docRef, map[string]interface{}{
+		"field1": "new-value",
+	})
+	batch.Update(docRef, []firestore.Update{
+		{Path: "field2", Value: "new-value-2"},
+	})
+	_, err = batch.Commit(ctx)
+	assert.Nil(t, err)
+
+	docSnap, err := docRef.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"field1": "new-value",
+		"field2": "new-value-2",
+	}, docSnap.Data())
+}
+
+func TestClientDocSnapshots(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	docRef := client.Doc("collection-1/document-1-1")
+	iter := docRef.Snapshots(ctx)
+	defer iter.Stop()
+
+	// initial snapshot
+	docSnap, err := iter.Next()
+	assert.Nil(t, err)
+	assert.True(t, docSnap.Exists())
+	assert.Equal(t, "value-1-1-1", docSnap.Data()["field1"])
+
+	// updated
+	_, err = docRef.Update(ctx, []firestore.Update{
+		{Path: "field1", Value: "new-value-1-1-1"},
+	})
+	assert.Nil(t, err)
+
+	docSnap, err = iter.Next()
+	assert.Nil(t, err)
+	assert.True(t, docSnap.Exists())
+	assert.Equal(t, "new-value-1-1-1", docSnap.Data()["field1"])
+
+	// writes to other documents don't produce snapshots
+	_, err = client.Doc("collection-1/document-1-2").Delete(ctx)
+	assert.Nil(t, err)
+
+	// deleted
+	_, err = docRef.Delete(ctx)
+	assert.Nil(t, err)
+
+	docSnap, err = iter.Next()
+	assert.Nil(t, err)
+	assert.False(t, docSnap.Exists())
+
+	// created
+	_, err = docRef.Set(ctx, map[string]interface{}{
+		"field1": "value",
+	})
+	assert.Nil(t, err)
+
+	docSnap, err = iter.Next()
+	assert.Nil(t, err)
+	assert.True(t, docSnap.Exists())
+	assert.Equal(t, "value", docSnap.Data()["field1"])
+}
+
+func TestClientQuerySnapshots(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	query := client.Collection("collection-1").Where("field4", "==", "equal").OrderBy("field1", firestore.Asc)
+	iter := query.Snapshots(ctx)
+	defer iter.Stop()
+
+	// initial snapshot
+	querySnap, err := iter.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, querySnap.Size)
+	assert.Len(t, querySnap.Changes, 2)
+	assert.Equal(t, firestore.DocumentAdded, querySnap.Changes[0].Kind)
+	assert.Equal(t, "document-1-1", querySnap.Changes[0].Doc.Ref.ID)
+
+	// added
+	_, err = client.Doc("collection-1/document-1-3").Set(ctx, map[string]interface{}{
+		"field1": "value-1-3-1",
+		"field4": "equal",
+	})
+	assert.Nil(t, err)
+
+	querySnap, err = iter.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, querySnap.Size)
+	assert.Len(t, querySnap.Changes, 1)
+	assert.Equal(t, firestore.DocumentAdded, querySnap.Changes[0].Kind)
+	assert.Equal(t, "document-1-3", querySnap.Changes[0].Doc.Ref.ID)
+	assert.Equal(t, 2, querySnap.Changes[0].NewIndex)
+
+	// modified
+	_, err = client.Doc("collection-1/document-1-1").Update(ctx, []firestore.Update{
+		{Path: "field2", Value: "new-value-1-1-2"},
+	})
+	assert.Nil(t, err)
+
+	querySnap, err = iter.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, querySnap.Size)
+	assert.Len(t, querySnap.Changes, 1)
+	assert.Equal(t, firestore.DocumentModified, querySnap.Changes[0].Kind)
+	assert.Equal(t, "new-value-1-1-2", querySnap.Changes[0].Doc.Data()["field2"])
+
+	// removed because it no longer matches
+	_, err = client.Doc("collection-1/document-1-2").Update(ctx, []firestore.Update{
+		{Path: "field4", Value: "not-equal"},
+	})
+	assert.Nil(t, err)
+
+	querySnap, err = iter.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, querySnap.Size)
+	assert.Len(t, querySnap.Changes, 1)
+	assert.Equal(t, firestore.DocumentRemoved, querySnap.Changes[0].Kind)
+	assert.Equal(t, "document-1-2", querySnap.Changes[0].Doc.Ref.ID)
+
+	// removed because it was deleted
+	_, err = client.Doc("collection-1/document-1-3").Delete(ctx)
+	assert.Nil(t, err)
+
+	querySnap, err = iter.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, querySnap.Size)
+	assert.Len(t, querySnap.Changes, 1)
+	assert.Equal(t, firestore.DocumentRemoved, querySnap.Changes[0].Kind)
+	assert.Equal(t, "document-1-3", querySnap.Changes[0].Doc.Ref.ID)
+}
+
+func TestClientAggregation(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// doubles from test.json
+	result, err := client.Collection("collection-1").NewAggregationQuery().
+		WithCount("count").
+		WithSum("field3", "sum").
+		WithAvg("field3", "avg").
+		Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), result["count"].(*firestorepb.Value).GetIntegerValue())
+	assert.Equal(t, 236.0, result["sum"].(*firestorepb.Value).GetDoubleValue())
+	assert.Equal(t, 118.0, result["avg"].(*firestorepb.Value).GetDoubleValue())
+
+	// filtered
+	query := client.Collection("collection-1").Where("field3", ">", 120)
+	result, err = query.NewAggregationQuery().
+		WithCount("count").
+		Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), result["count"].(*firestorepb.Value).GetIntegerValue())
+
+	// integers, ignoring non-numeric values
+	collection := client.Collection("collection-3")
+	for i, value := range []interface{}{1, 2, "3", nil} {
+		_, err = collection.Doc(fmt.Sprintf("document-3-%d", i)).Set(ctx, map[string]interface{}{
+			"field1": value,
+		})
+		assert.Nil(t, err)
+	}
+	result, err = collection.NewAggregationQuery().
+		WithCount("count").
+		WithSum("field1", "sum").
+		WithAvg("field1", "avg").
+		WithSum("field2", "sum_missing").
+		WithAvg("field2", "avg_missing").
+		Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), result["count"].(*firestorepb.Value).GetIntegerValue())
+	assert.Equal(t, &firestorepb.Value_IntegerValue{IntegerValue: 3}, result["sum"].(*firestorepb.Value).GetValueType())
+	assert.Equal(t, 1.5, result["avg"].(*firestorepb.Value).GetDoubleValue())
+	assert.Equal(t, &firestorepb.Value_IntegerValue{IntegerValue: 0}, result["sum_missing"].(*firestorepb.Value).GetValueType())
+	assert.IsType(t, &firestorepb.Value_NullValue{}, result["avg_missing"].(*firestorepb.Value).GetValueType())
+
+	// integer overflow becomes a double
+	_, err = collection.Doc("document-3-4").Set(ctx, map[string]interface{}{
+		"field1": math.MaxInt64,
+	})
+	assert.Nil(t, err)
+	result, err = collection.NewAggregationQuery().
+		WithSum("field1", "sum").
+		Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, &firestorepb.Value_DoubleValue{DoubleValue: float64(math.MaxInt64) + 3}, result["sum"].(*firestorepb.Value).GetValueType())
+
+	// limit applies before aggregating
+	query = collection.Limit(2)
+	result, err = query.NewAggregationQuery().
+		WithCount("count").
+		Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), result["count"].(*firestorepb.Value).GetIntegerValue())
+}
+
+func TestClientCursors(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	collection := client.Collection("collection-3")
+	for i := 1; i <= 5; i++ {
+		_, err = collection.Doc(fmt.Sprintf("document-3-%d", i)).Set(ctx, map[string]interface{}{
+			"field1": float64(i),
+			"field2": float64(i % 2),
+		})
+		assert.Nil(t, err)
+	}
+	ids := func(docSnaps []*firestore.DocumentSnapshot) []string {
+		ids := []string{}
+		for _, docSnap := range docSnaps {
+			ids = append(ids, docSnap.Ref.ID)
+		}
+		return ids
+	}
+
+	docSnaps, err := collection.OrderBy("field1", firestore.Asc).StartAt(2.0).EndBefore(4.0).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"document-3-2", "document-3-3"}, ids(docSnaps))
+
+	docSnaps, err = collection.OrderBy("field1", firestore.Asc).StartAfter(2.0).EndAt(4.0).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"document-3-3", "document-3-4"}, ids(docSnaps))
+
+	docSnaps, err = collection.OrderBy("field1", firestore.Desc).StartAfter(4.0).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"document-3-3", "document-3-2", "document-3-1"}, ids(docSnaps))
+
+	// multiple order bys
+	docSnaps, err = collection.OrderBy("field2", firestore.Asc).OrderBy("field1", firestore.Desc).StartAt(0.0, 2.0).EndAt(1.0, 3.0).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"document-3-2", "document-3-5", "document-3-3"}, ids(docSnaps))
+
+	// document ID cursors
+	docSnaps, err = collection.OrderBy(firestore.DocumentID, firestore.Asc).StartAfter("document-3-3").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"document-3-4", "document-3-5"}, ids(docSnaps))
+
+	// paginate with document snapshot cursors, which order by name implicitly
+	query := collection.OrderBy("field2", firestore.Desc).Limit(2)
+	docSnaps, err = query.Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"document-3-5", "document-3-3"}, ids(docSnaps))
+
+	docSnaps, err = query.StartAfter(docSnaps[1]).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"document-3-1", "document-3-4"}, ids(docSnaps))
+
+	docSnaps, err = query.StartAfter(docSnaps[1]).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"document-3-2"}, ids(docSnaps))
+}
+
+func TestClientCollectionGroup(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	for i, path := range []string{
+		"comments/comment-1",
+		"collection-1/document-1-1/comments/comment-2",
+		"collection-2/document-2-4/subcollection-2-4/subdocument-2-4-1/comments/comment-3",
+		"collection-3/document-xxxxx/comments/comment-4", // parent document doesn't exist
+		"collection-1/document-1-1/not-comments/comment-5",
+	} {
+		_, err = client.Doc(path).Set(ctx, map[string]interface{}{
+			"field1": float64(i),
+		})
+		assert.Nil(t, err)
+	}
+
+	docSnaps, err := client.CollectionGroup("comments").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 4)
+	assert.Equal(t, "projects/projectID/databases/(default)/documents/collection-1/document-1-1/comments/comment-2", docSnaps[0].Ref.Path)
+	assert.Equal(t, "projects/projectID/databases/(default)/documents/collection-2/document-2-4/subcollection-2-4/subdocument-2-4-1/comments/comment-3", docSnaps[1].Ref.Path)
+	assert.Equal(t, "projects/projectID/databases/(default)/documents/collection-3/document-xxxxx/comments/comment-4", docSnaps[2].Ref.Path)
+	assert.Equal(t, "projects/projectID/databases/(default)/documents/comments/comment-1", docSnaps[3].Ref.Path)
+
+	docSnaps, err = client.CollectionGroup("comments").Where("field1", ">=", 2).OrderBy("field1", firestore.Desc).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+	assert.Equal(t, "comment-4", docSnaps[0].Ref.ID)
+	assert.Equal(t, "comment-3", docSnaps[1].Ref.ID)
+
+	docSnaps, err = client.CollectionGroup("subcollection-2-4").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+
+	docSnaps, err = client.CollectionGroup("nonexistent").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 0)
+}
+
+func TestClientSelect(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	docSnaps, err := client.Collection("collection-1").Select("field1", "field7.subfield2", "nonexistent").Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+	assert.Equal(t, map[string]interface{}{
+		"field1": "value-1-1-1",
+		"field7": map[string]interface{}{
+			"subfield2": "subvalue-1-1-1-2",
+		},
+	}, docSnaps[0].Data())
+	assert.Equal(t, map[string]interface{}{
+		"field1": "value-1-2-1",
+		"field7": map[string]interface{}{
+			"subfield2": "subvalue-1-2-1-2",
+		},
+	}, docSnaps[1].Data())
+
+	// keys only
+	docSnaps, err = client.Collection("collection-1").Select().Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+	assert.Equal(t, "document-1-1", docSnaps[0].Ref.ID)
+	assert.Equal(t, map[string]interface{}{}, docSnaps[0].Data())
+	assert.Equal(t, "document-1-2", docSnaps[1].Ref.ID)
+	assert.Equal(t, map[string]interface{}{}, docSnaps[1].Data())
+
+	// projection doesn't modify the stored document
+	docSnap, err := client.Doc("collection-1/document-1-1").Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "value-1-1-2", docSnap.Data()["field2"])
+}
+
+func TestClientWhere_unary(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	for id, value := range map[string]interface{}{
+		"null":   nil,
+		"nan":    math.NaN(),
+		"number": float64(1),
+		"string": "value",
+	} {
+		_, err = client.Doc("collection-1/"+id).Set(ctx, map[string]interface{}{
+			"field1": value,
+		})
+		assert.Nil(t, err)
+	}
+	_, err = client.Doc("collection-1/missing").Set(ctx, map[string]interface{}{
+		"field2": "value",
+	})
+	assert.Nil(t, err)
+
+	docSnap, err := client.Doc("collection-1/null").Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"field1": nil}, docSnap.Data())
+
+	ids := func(query firestore.Query) []string {
+		docSnaps, err := query.Documents(ctx).GetAll()
+		assert.Nil(t, err)
+		ids := []string{}
+		for _, docSnap := range docSnaps {
+			ids = append(ids, docSnap.Ref.ID)
+		}
+		return ids
+	}
+
+	collection := client.Collection("collection-1")
+	assert.Equal(t, []string{"null"}, ids(collection.Where("field1", "==", nil)))
+	assert.Equal(t, []string{"nan"}, ids(collection.Where("field1", "==", math.NaN())))
+	assert.Equal(t, []string{"nan", "null"}, ids(collection.WhereEntity(firestore.OrFilter{
+		Filters: []firestore.EntityFilter{
+			firestore.PropertyFilter{Path: "field1", Operator: "==", Value: nil},
+			firestore.PropertyFilter{Path: "field1", Operator: "==", Value: math.NaN()},
+		},
+	})))
+
+	// the client doesn't support the negated operators, so run them directly
+	for op, expected := range map[firestorepb.StructuredQuery_UnaryFilter_Operator][]string{
+		firestorepb.StructuredQuery_UnaryFilter_IS_NOT_NULL: {"nan", "number", "string"},
+		firestorepb.StructuredQuery_UnaryFilter_IS_NOT_NAN:  {"number", "string"},
+	} {
+		docs, err := srv.runQuery("projects/projectID/databases/(default)/documents", &firestorepb.StructuredQuery{
+			From: []*firestorepb.StructuredQuery_CollectionSelector{{CollectionId: "collection-1"}},
+			Where: &firestorepb.StructuredQuery_Filter{
+				FilterType: &firestorepb.StructuredQuery_Filter_UnaryFilter{
+					UnaryFilter: &firestorepb.StructuredQuery_UnaryFilter{
+						Op: op,
+						OperandType: &firestorepb.StructuredQuery_UnaryFilter_Field{
+							Field: &firestorepb.StructuredQuery_FieldReference{FieldPath: "field1"},
+						},
+					},
+				},
+			},
+		})
+		assert.Nil(t, err)
+		names := []string{}
+		for _, doc := range docs {
+			names = append(names, strings.TrimPrefix(doc.name, "collection-1/"))
+		}
+		assert.Equal(t, expected, names)
+	}
+}
+
+func TestClientNull(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	filename := filepath.Join(t.TempDir(), "null.json")
+	err = os.WriteFile(filename, []byte(`{
+		"collection-1": {
+			"document-1": {
+				"field1": null,
+				"field2": {"subfield1": null},
+				"field3": [1, null]
+			}
+		}
+	}`), 0644)
+	assert.Nil(t, err)
+	err = srv.LoadFromJSONFile(filename)
+	assert.Nil(t, err)
+
+	docSnap, err := client.Doc("collection-1/document-1").Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"field1": nil,
+		"field2": map[string]interface{}{"subfield1": nil},
+		"field3": []interface{}{float64(1), nil},
+	}, docSnap.Data())
+
+	_, err = client.Doc("collection-1/document-2").Set(ctx, map[string]interface{}{
+		"field1": "value",
+		"field2": map[string]interface{}{"subfield1": "value"},
+		"field3": []interface{}{nil, "value"},
+	})
+	assert.Nil(t, err)
+	_, err = client.Doc("collection-1/document-3").Set(ctx, map[string]interface{}{
+		"field1": nil,
+		"field2": map[string]interface{}{"subfield1": nil},
+		"field3": []interface{}{nil},
+	})
+	assert.Nil(t, err)
+	_, err = client.Doc("collection-1/document-3").Update(ctx, []firestore.Update{
+		{Path: "field4", Value: nil},
+	})
+	assert.Nil(t, err)
+
+	docSnap, err = client.Doc("collection-1/document-3").Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"field1": nil,
+		"field2": map[string]interface{}{"subfield1": nil},
+		"field3": []interface{}{nil},
+		"field4": nil,
+	}, docSnap.Data())
+
+	ids := func(query firestore.Query) []string {
+		docSnaps, err := query.Documents(ctx).GetAll()
+		assert.Nil(t, err)
+		ids := []string{}
+		for _, docSnap := range docSnaps {
+			ids = append(ids, docSnap.Ref.ID)
+		}
+		return ids
+	}
+
+	collection := client.Collection("collection-1")
+	assert.Equal(t, []string{"document-1", "document-3"}, ids(collection.Where("field1", "==", nil)))
+	assert.Equal(t, []string{"document-1", "document-3"}, ids(collection.Where("field2.subfield1", "==", nil)))
+	assert.Equal(t, []string{"document-1", "document-2", "document-3"}, ids(collection.Where("field3", "array-contains-any", []interface{}{nil})))
+	assert.Equal(t, []string{"document-1", "document-2", "document-3"}, ids(collection.Where("field1", "in", []interface{}{nil, "value"})))
+	assert.Equal(t, []string{"document-2"}, ids(collection.Where("field1", "not-in", []interface{}{"other"})))
+
+	// null values are ordered first
+	assert.Equal(t, []string{"document-1", "document-3", "document-2"}, ids(collection.OrderBy("field1", firestore.Asc)))
+	assert.Equal(t, []string{"document-2", "document-3", "document-1"}, ids(collection.OrderBy("field1", firestore.Desc)))
+	assert.Equal(t, []string{"document-2"}, ids(collection.OrderBy("field1", firestore.Asc).StartAfter(nil)))
+}
+
+func TestClientGeoPointAndReference(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	filename := filepath.Join(t.TempDir(), "geo.json")
+	err = os.WriteFile(filename, []byte(`{
+		"collection-1": {
+			"document-1": {
+				"field1": "geo:37.7749,-122.4194",
+				"field2": "projects/projectID/databases/(default)/documents/collection-2/document-2"
+			}
+		}
+	}`), 0644)
+	assert.Nil(t, err)
+	err = srv.LoadFromJSONFile(filename)
+	assert.Nil(t, err)
+
+	docSnap, err := client.Doc("collection-1/document-1").Get(ctx)
+	assert.Nil(t, err)
+	point, ok := docSnap.Data()["field1"].(*latlng.LatLng)
+	assert.True(t, ok)
+	assert.Equal(t, 37.7749, point.GetLatitude())
+	assert.Equal(t, -122.4194, point.GetLongitude())
+	ref, ok := docSnap.Data()["field2"].(*firestore.DocumentRef)
+	assert.True(t, ok)
+	assert.Equal(t, "collection-2", ref.Parent.ID)
+	assert.Equal(t, "document-2", ref.ID)
+
+	_, err = client.Doc("collection-1/document-2").Set(ctx, map[string]interface{}{
+		"field1": &latlng.LatLng{Latitude: 40.7128, Longitude: -74.0060},
+		"field2": client.Doc("collection-2/document-1"),
+		"field3": map[string]interface{}{
+			"subfield1": []interface{}{client.Doc("collection-2/document-3")},
+		},
+	})
+	assert.Nil(t, err)
+
+	docSnap, err = client.Doc("collection-1/document-2").Get(ctx)
+	assert.Nil(t, err)
+	point, ok = docSnap.Data()["field1"].(*latlng.LatLng)
+	assert.True(t, ok)
+	assert.Equal(t, 40.7128, point.GetLatitude())
+	ref, ok = docSnap.Data()["field2"].(*firestore.DocumentRef)
+	assert.True(t, ok)
+	assert.Equal(t, "document-1", ref.ID)
+	refs, ok := docSnap.Data()["field3"].(map[string]interface{})["subfield1"].([]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "document-3", refs[0].(*firestore.DocumentRef).ID)
+
+	ids := func(query firestore.Query) []string {
+		docSnaps, err := query.Documents(ctx).GetAll()
+		assert.Nil(t, err)
+		ids := []string{}
+		for _, docSnap := range docSnaps {
+			ids = append(ids, docSnap.Ref.ID)
+		}
+		return ids
+	}
+
+	collection := client.Collection("collection-1")
+	assert.Equal(t, []string{"document-1"}, ids(collection.Where("field1", "==", &latlng.LatLng{Latitude: 37.7749, Longitude: -122.4194})))
+	assert.Equal(t, []string{"document-2"}, ids(collection.Where("field1", ">", &latlng.LatLng{Latitude: 38, Longitude: 0})))
+	assert.Equal(t, []string{"document-2"}, ids(collection.Where("field2", "==", client.Doc("collection-2/document-1"))))
+	assert.Equal(t, []string{"document-1"}, ids(collection.Where("field2", "not-in", []interface{}{client.Doc("collection-2/document-1")})))
+	assert.Equal(t, []string{"document-2"}, ids(collection.Where("field3.subfield1", "array-contains", client.Doc("collection-2/document-3"))))
+	assert.Equal(t, []string{"document-2", "document-1"}, ids(collection.OrderBy("field1", firestore.Desc)))
+	assert.Equal(t, []string{"document-1", "document-2"}, ids(collection.OrderBy("field2", firestore.Desc)))
+}
+
+func TestClientVector(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	filename := filepath.Join(t.TempDir(), "vector.json")
+	err = os.WriteFile(filename, []byte(`{
+		"collection-1": {
+			"document-1": {
+				"field1": {"__type__": "__vector__", "value": [1, 0]},
+				"field2": "a"
+			}
+		}
+	}`), 0644)
+	assert.Nil(t, err)
+	err = srv.LoadFromJSONFile(filename)
+	assert.Nil(t, err)
+
+	for id, data := range map[string]map[string]interface{}{
+		"document-2": {"field1": firestore.Vector64{0, 1}, "field2": "a"},
+		"document-3": {"field1": firestore.Vector32{2, 2}, "field2": "b"},
+		"document-4": {"field1": firestore.Vector64{-1, -1}, "field2": "a"},
+		"document-5": {"field1": firestore.Vector64{1, 1, 1}, "field2": "a"}, // different dimension
+		"document-6": {"field1": []float64{1, 0}, "field2": "a"},             // not a vector
+	} {
+		_, err = client.Doc("collection-1/"+id).Set(ctx, data)
+		assert.Nil(t, err)
+	}
+
+	docSnap, err := client.Doc("collection-1/document-1").Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, firestore.Vector64{1, 0}, docSnap.Data()["field1"])
+	docSnap, err = client.Doc("collection-1/document-3").Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, firestore.Vector64{2, 2}, docSnap.Data()["field1"])
+
+	ids := func(query firestore.Query) []string {
+		docSnaps, err := query.Documents(ctx).GetAll()
+		assert.Nil(t, err)
+		ids := []string{}
+		for _, docSnap := range docSnaps {
+			ids = append(ids, docSnap.Ref.ID)
+		}
+		return ids
+	}
+	nearest := func(query firestore.VectorQuery) []*firestore.DocumentSnapshot {
+		docSnaps, err := query.Documents(ctx).GetAll()
+		assert.Nil(t, err)
+		return docSnaps
+	}
+
+	collection := client.Collection("collection-1")
+	assert.Equal(t, []string{"document-3"}, ids(collection.Where("field1", "==", firestore.Vector64{2, 2})))
+
+	docSnaps := nearest(collection.FindNearest("field1", firestore.Vector64{1, 0.5}, 10, firestore.DistanceMeasureEuclidean, &firestore.FindNearestOptions{
+		DistanceResultField: "distance",
+	}))
+	assert.Len(t, docSnaps, 4)
+	assert.Equal(t, "document-1", docSnaps[0].Ref.ID)
+	assert.Equal(t, 0.5, docSnaps[0].Data()["distance"])
+	assert.Equal(t, "document-2", docSnaps[1].Ref.ID)
+	assert.Equal(t, "document-3", docSnaps[2].Ref.ID)
+	assert.Equal(t, "document-4", docSnaps[3].Ref.ID)
+	assert.Equal(t, 2.5, docSnaps[3].Data()["distance"])
+
+	docSnaps = nearest(collection.FindNearest("field1", []float64{1, 1}, 2, firestore.DistanceMeasureCosine, nil))
+	assert.Len(t, docSnaps, 2)
+	assert.Equal(t, "document-3", docSnaps[0].Ref.ID)
+	assert.Equal(t, "document-1", docSnaps[1].Ref.ID)
+
+	docSnaps = nearest(collection.FindNearest("field1", []float64{1, 1}, 10, firestore.DistanceMeasureDotProduct, &firestore.FindNearestOptions{
+		DistanceResultField: "distance",
+	}))
+	assert.Len(t, docSnaps, 4)
+	assert.Equal(t, "document-3", docSnaps[0].Ref.ID)
+	assert.Equal(t, 4.0, docSnaps[0].Data()["distance"])
+	assert.Equal(t, "document-1", docSnaps[1].Ref.ID)
+	assert.Equal(t, "document-2", docSnaps[2].Ref.ID)
+	assert.Equal(t, "document-4", docSnaps[3].Ref.ID)
+
+	// pre-filtered and with a distance threshold
+	threshold := 2.5
+	docSnaps = nearest(collection.Where("field2", "==", "a").FindNearest("field1", []float64{2, 2}, 10, firestore.DistanceMeasureEuclidean, &firestore.FindNearestOptions{
+		DistanceThreshold: &threshold,
+	}))
+	assert.Len(t, docSnaps, 2)
+	assert.Equal(t, "document-1", docSnaps[0].Ref.ID)
+	assert.Equal(t, "document-2", docSnaps[1].Ref.ID)
+
+	_, err = collection.FindNearest("field1", []float64{1, 1}, 0, firestore.DistanceMeasureEuclidean, nil).Documents(ctx).GetAll()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientOrderBy_types(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	values := []interface{}{
+		nil,
+		false,
+		true,
+		math.NaN(),
+		math.Inf(-1),
+		int64(-1),
+		0.5,
+		int64(1),
+		1.5,
+		int64(math.MaxInt64),
+		math.Inf(1),
+		time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		"a",
+		"b",
+		[]byte("a"),
+		client.Doc("collection-2/document-1"),
+		client.Doc("collection-2/document-1/subcollection-1/document-1"),
+		client.Doc("collection-2/document-2"),
+		&latlng.LatLng{Latitude: 1, Longitude: 2},
+		[]interface{}{"a"},
+		[]interface{}{"a", "b"},
+		[]interface{}{"b"},
+		firestore.Vector64{2, 2},
+		firestore.Vector64{1, 1, 1},
+		map[string]interface{}{"a": "a"},
+		map[string]interface{}{"a": "a", "b": "b"},
+		map[string]interface{}{"b": "a"},
+	}
+	expected := []string{}
+	for i, value := range values {
+		id := fmt.Sprintf("document-%02d", i)
+		expected = append(expected, id)
+		_, err = client.Doc("collection-1/"+id).Set(ctx, map[string]interface{}{
+			"field1": value,
+		})
+		assert.Nil(t, err)
+	}
+
+	ids := func(query firestore.Query) []string {
+		docSnaps, err := query.Documents(ctx).GetAll()
+		assert.Nil(t, err)
+		ids := []string{}
+		for _, docSnap := range docSnaps {
+			ids = append(ids, docSnap.Ref.ID)
+		}
+		return ids
+	}
+
+	collection := client.Collection("collection-1")
+	assert.Equal(t, expected, ids(collection.OrderBy("field1", firestore.Asc)))
+
+	reversed := []string{}
+	for i := len(expected) - 1; i >= 0; i-- {
+		reversed = append(reversed, expected[i])
+	}
+	assert.Equal(t, reversed, ids(collection.OrderBy("field1", firestore.Desc)))
+
+	// integers and doubles are compared numerically, and range filters only
+	// match values of the same type
+	assert.Equal(t, []string{"document-07", "document-08", "document-09", "document-10"}, ids(collection.Where("field1", ">=", 1)))
+	assert.Equal(t, []string{"document-07", "document-08", "document-09", "document-10"}, ids(collection.Where("field1", ">", 0.5)))
+	assert.Equal(t, []string{"document-04", "document-05", "document-06"}, ids(collection.Where("field1", "<", 1)))
+	assert.Equal(t, []string{"document-07"}, ids(collection.Where("field1", "==", 1.0)))
+	assert.Equal(t, []string{"document-06", "document-07"}, ids(collection.Where("field1", "in", []interface{}{0.5, int64(1), "c"})))
+	assert.Equal(t, []string{"document-12", "document-13"}, ids(collection.Where("field1", ">=", "")))
+	assert.Equal(t, []string{"document-19", "document-20", "document-21"}, ids(collection.Where("field1", ">=", []interface{}{})))
+	assert.Len(t, ids(collection.Where("field1", "!=", false)), len(values)-2)
+
+	// maps are only equal if they have the same keys, and range filters agree
+	// with the ordering
+	m := map[string]interface{}{"a": "a"}
+	assert.Equal(t, []string{"document-24"}, ids(collection.Where("field1", "==", m)))
+	assert.Len(t, ids(collection.Where("field1", "!=", m)), len(values)-2)
+	assert.Equal(t, []string{"document-25", "document-26"}, ids(collection.Where("field1", ">", m)))
+	assert.Equal(t, []string{"document-25", "document-26"}, ids(collection.OrderBy("field1", firestore.Asc).StartAfter(m)))
+	assert.Equal(t, []string{"document-24", "document-25"}, ids(collection.Where("field1", "<=", map[string]interface{}{"a": "a", "b": "b"})))
+}
+
+func TestClientOrderBy_existence(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	_, err = client.Doc("collection-1/document-1-3").Set(ctx, map[string]interface{}{
+		"field1": "value-1-3-1",
+		"field3": nil,
+	})
+	assert.Nil(t, err)
+
+	// documents without the field are excluded, null values are not
+	docSnaps, err := client.Collection("collection-1").OrderBy("field3", firestore.Asc).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 3)
+	assert.Equal(t, "document-1-3", docSnaps[0].Ref.ID)
+	assert.Equal(t, "document-1-1", docSnaps[1].Ref.ID)
+	assert.Equal(t, "document-1-2", docSnaps[2].Ref.ID)
+
+	docSnaps, err = client.Collection("collection-1").OrderBy("field1", firestore.Asc).OrderBy("field5", firestore.Asc).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+	assert.Equal(t, "document-1-1", docSnaps[0].Ref.ID)
+	assert.Equal(t, "document-1-2", docSnaps[1].Ref.ID)
+
+	docSnaps, err = client.Collection("collection-1").OrderBy("field7.subfield1", firestore.Desc).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+	assert.Equal(t, "document-1-2", docSnaps[0].Ref.ID)
+
+	docSnaps, err = client.Collection("collection-1").OrderBy("nonexistent", firestore.Asc).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 0)
+
+	// the first order by must be the inequality field
+	docSnaps, err = client.Collection("collection-1").Where("field3", ">", 100).OrderBy("field3", firestore.Desc).OrderBy("field1", firestore.Asc).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 2)
+	assert.Equal(t, "document-1-2", docSnaps[0].Ref.ID)
+
+	_, err = client.Collection("collection-1").Where("field3", ">", 100).OrderBy("field1", firestore.Asc).Documents(ctx).GetAll()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Collection("collection-1").Where("field3", "not-in", []interface{}{113}).OrderBy("field1", firestore.Asc).Documents(ctx).GetAll()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Collection("collection-1").Where("field3", "==", 113).OrderBy("field1", firestore.Asc).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+
+	// without an order by, the results are ordered by the inequality field
+	for id, n := range map[string]int{"a": 3, "b": 1, "c": 2} {
+		_, err = client.Doc("collection-3/"+id).Set(ctx, map[string]interface{}{
+			"n": n,
+		})
+		assert.Nil(t, err)
+	}
+	docSnaps, err = client.Collection("collection-3").Where("n", ">", 0).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 3)
+	assert.Equal(t, "b", docSnaps[0].Ref.ID)
+	assert.Equal(t, "c", docSnaps[1].Ref.ID)
+	assert.Equal(t, "a", docSnaps[2].Ref.ID)
+
+	docSnaps, err = client.Collection("collection-3").Where("n", ">", 0).Limit(1).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 1)
+	assert.Equal(t, "b", docSnaps[0].Ref.ID)
+
+	docSnaps, err = client.Collection("collection-3").Where("n", "!=", 2).Limit(1).Documents(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 1)
+	assert.Equal(t, "b", docSnaps[0].Ref.ID)
+}
+
+func TestClientWhere_validation(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	values := func(n int) []interface{} {
+		values := []interface{}{}
+		for i := 0; i < n; i++ {
+			values = append(values, i)
+		}
+		return values
+	}
+
+	collection := client.Collection("collection-1")
+	for _, test := range []struct {
+		query firestore.Query
+		code  codes.Code
+	}{
+		{collection.Where("field3", "in", values(30)), codes.OK},
+		{collection.Where("field3", "in", values(31)), codes.InvalidArgument},
+		{collection.Where("field6", "array-contains-any", values(31)), codes.InvalidArgument},
+		{collection.Where("field3", "not-in", values(10)), codes.OK},
+		{collection.Where("field3", "not-in", values(11)), codes.InvalidArgument},
+		{collection.Where("field3", "in", values(6)).Where("field1", "in", values(5)), codes.OK},
+		{collection.Where("field3", "in", values(6)).Where("field1", "in", values(6)), codes.InvalidArgument},
+		{collection.WhereEntity(firestore.OrFilter{
+			Filters: []firestore.EntityFilter{
+				firestore.PropertyFilter{Path: "field3", Operator: "in", Value: values(20)},
+				firestore.PropertyFilter{Path: "field1", Operator: "in", Value: values(11)},
+			},
+		}), codes.InvalidArgument},
+		{collection.Where("field3", "not-in", values(2)).Where("field3", "!=", 1), codes.InvalidArgument},
+		{collection.Where("field3", "not-in", values(2)).Where("field1", "in", values(2)), codes.InvalidArgument},
+		{collection.Where("field6", "array-contains", 1).Where("field6", "array-contains", 2), codes.InvalidArgument},
+		{collection.Where("field6", "array-contains", 1).Where("field6", "array-contains-any", values(2)), codes.InvalidArgument},
+		{collection.WhereEntity(firestore.OrFilter{
+			Filters: []firestore.EntityFilter{
+				firestore.PropertyFilter{Path: "field6", Operator: "array-contains", Value: 1},
+				firestore.PropertyFilter{Path: "field6", Operator: "array-contains", Value: 2},
+			},
+		}), codes.OK},
+		// inequalities on multiple fields are allowed when indexes aren't enforced
+		{collection.Where("field3", ">", 1).Where("field1", "<", "b"), codes.OK},
+		{collection.Where("field3", ">", 1).Where("field1", "<", "b").OrderBy("field1", firestore.Asc), codes.OK},
+		{collection.Where("field3", ">", 1).Where("field1", "<", "b").OrderBy("field2", firestore.Asc), codes.InvalidArgument},
+		{collection.Where("field3", ">", 1).Where("field3", "<", 200), codes.OK},
+	} {
+		_, err = test.query.Documents(ctx).GetAll()
+		assert.Equal(t, test.code, status.Code(err), err)
+	}
+
+	// the client doesn't send negative offsets or limits. Firestore has no
+	// maximum offset.
+	_, err = srv.runQuery("projects/projectID/databases/(default)/documents", &firestorepb.StructuredQuery{
+		From:   []*firestorepb.StructuredQuery_CollectionSelector{{CollectionId: "collection-1"}},
+		Offset: -1,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientIndexes(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	collection := client.Collection("collection-1")
+	query := collection.Where("field4", "==", "equal").OrderBy("field3", firestore.Desc)
+
+	// indexes aren't enforced by default
+	_, err = query.Documents(ctx).GetAll()
+	assert.Nil(t, err)
+
+	filename := filepath.Join(t.TempDir(), "firestore.indexes.json")
+	err = os.WriteFile(filename, []byte(`{
+		"indexes": [
+			{
+				"collectionGroup": "collection-1",
+				"queryScope": "COLLECTION",
+				"fields": [
+					{"fieldPath": "field4", "order": "ASCENDING"},
+					{"fieldPath": "field3", "order": "ASCENDING"}
+				]
+			},
+			{
+				"collectionGroup": "collection-1",
+				"queryScope": "COLLECTION",
+				"fields": [
+					{"fieldPath": "field6", "arrayConfig": "CONTAINS"},
+					{"fieldPath": "field5", "order": "ASCENDING"},
+					{"fieldPath": "field3", "order": "DESCENDING"},
+					{"fieldPath": "__name__", "order": "DESCENDING"}
+				]
+			},
+			{
+				"collectionGroup": "collection-1",
+				"queryScope": "COLLECTION",
+				"fields": [
+					{"fieldPath": "field3", "order": "ASCENDING"},
+					{"fieldPath": "field5", "order": "ASCENDING"}
+				]
+			},
+			{
+				"collectionGroup": "subcollection-2-4",
+				"queryScope": "COLLECTION_GROUP",
+				"fields": [
+					{"fieldPath": "field1", "order": "ASCENDING"},
+					{"fieldPath": "field2", "order": "DESCENDING"}
+				]
+			}
+		],
+		"fieldOverrides": []
+	}`), 0644)
+	assert.Nil(t, err)
+	err = srv.LoadIndexesFromJSONFile(filename)
+	assert.Nil(t, err)
+
+	for _, test := range []struct {
+		query firestore.Query
+		code  codes.Code
+	}{
+		// single field indexes
+		{collection.Where("field1", "==", "value-1-1-1"), codes.OK},
+		{collection.Where("field1", "==", "value-1-1-1").Where("field4", "==", "equal"), codes.OK},
+		{collection.Where("field3", ">", 100), codes.OK},
+		{collection.OrderBy("field3", firestore.Desc), codes.OK},
+		{collection.Where("field3", "==", 113).OrderBy("field3", firestore.Asc), codes.OK},
+		// composite indexes
+		{query, codes.OK},
+		{collection.Where("field4", "in", []string{"equal"}).OrderBy("field3", firestore.Asc), codes.OK},
+		{collection.Where("field4", "==", "equal").Where("field3", ">", 100), codes.OK},
+		{collection.Where("field6", "array-contains", 1).OrderBy("field5", firestore.Desc).OrderBy("field3", firestore.Asc), codes.OK},
+		{collection.Where("field6", "array-contains", 1).OrderBy("field5", firestore.Asc).OrderBy("field3", firestore.Asc), codes.FailedPrecondition},
+		{collection.Where("field1", "==", "value-1-1-1").OrderBy("field3", firestore.Asc), codes.FailedPrecondition},
+		{collection.OrderBy("field4", firestore.Desc).OrderBy("field3", firestore.Desc), codes.OK},
+		{collection.OrderBy("field4", firestore.Desc).OrderBy("field3", firestore.Asc), codes.FailedPrecondition},
+		{collection.WhereEntity(firestore.OrFilter{
+			Filters: []firestore.EntityFilter{
+				firestore.PropertyFilter{Path: "field4", Operator: "==", Value: "equal"},
+				firestore.PropertyFilter{Path: "field1", Operator: "==", Value: "value-1-1-1"},
+			},
+		}).OrderBy("field3", firestore.Asc), codes.FailedPrecondition},
+		{collection.WhereEntity(firestore.OrFilter{
+			Filters: []firestore.EntityFilter{
+				firestore.PropertyFilter{Path: "field3", Operator: "==", Value: nil},
+				firestore.PropertyFilter{Path: "field4", Operator: "==", Value: "equal"},
+			},
+		}).OrderBy("field3", firestore.Asc), codes.OK},
+		{collection.WhereEntity(firestore.OrFilter{
+			Filters: []firestore.EntityFilter{
+				firestore.PropertyFilter{Path: "field3", Operator: "==", Value: nil},
+				firestore.PropertyFilter{Path: "field1", Operator: "==", Value: "value-1-1-1"},
+			},
+		}).OrderBy("field3", firestore.Asc), codes.FailedPrecondition},
+		{client.CollectionGroup("subcollection-2-4").Where("field1", "==", "value-2-4-1-1").OrderBy("field2", firestore.Asc), codes.OK},
+		{client.Collection("collection-2/document-2-4/subcollection-2-4").Where("field1", "==", "value-2-4-1-1").OrderBy("field2", firestore.Asc), codes.FailedPrecondition},
+		// inequalities on multiple fields
+		{collection.Where("field3", ">", 100).Where("field5", ">", 0), codes.OK},
+		{collection.Where("field3", ">", 100).Where("field4", ">", ""), codes.FailedPrecondition},
+		{collection.Where("field4", ">", "").OrderBy("field4", firestore.Desc).OrderBy("field3", firestore.Desc), codes.OK},
+		{collection.Where("field4", ">", "").Where("field3", ">", 100).OrderBy("field4", firestore.Desc), codes.OK},
+		{collection.Where("field4", ">", "").Where("field3", ">", 100).OrderBy("field4", firestore.Asc), codes.OK},
+		{collection.Where("field4", ">", "").Where("field3", ">", 100).OrderBy("field3", firestore.Asc), codes.FailedPrecondition},
+	} {
+		_, err = test.query.Documents(ctx).GetAll()
+		assert.Equal(t, test.code, status.Code(err), err)
+	}
+
+	_, err = collection.Where("field1", "==", "value-1-1-1").OrderBy("field3", firestore.Asc).Documents(ctx).GetAll()
+	assert.Contains(t, status.Convert(err).Message(), "requires an index")
+	assert.Contains(t, status.Convert(err).Message(), `{"collectionGroup":"collection-1","queryScope":"COLLECTION","fields":[{"fieldPath":"field1","order":"ASCENDING"},{"fieldPath":"field3","order":"ASCENDING"}]}`)
+
+	// vector indexes
+	_, err = collection.FindNearest("field6", firestore.Vector64{1, 2}, 1, firestore.DistanceMeasureEuclidean, nil).Documents(ctx).GetAll()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestClientListDocuments(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// document-2-5 only exists because it has a subcollection
+	_, err = client.Doc("collection-2/document-2-5/subcollection-2-5/subdocument-2-5-1").Set(ctx, map[string]interface{}{
+		"field1": "value-2-5-1-1",
+	})
+	assert.Nil(t, err)
+
+	docRefs, err := client.Collection("collection-2").DocumentRefs(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docRefs, 3)
+	assert.Equal(t, "document-2-3", docRefs[0].ID)
+	assert.Equal(t, "document-2-4", docRefs[1].ID)
+	assert.Equal(t, "document-2-5", docRefs[2].ID)
+
+	docRefs, err = client.Collection("collection-2/document-2-4/subcollection-2-4").DocumentRefs(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docRefs, 2)
+
+	docRefs, err = client.Collection("nonexistent").DocumentRefs(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, docRefs, 0)
+
+	// missing documents are only listed with show missing
+	parent := "projects/projectID/databases/(default)/documents"
+	resp, err := srv.ListDocuments(ctx, &firestorepb.ListDocumentsRequest{
+		Parent:       parent,
+		CollectionId: "collection-2",
+	})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Documents, 2)
+	assert.Equal(t, "value-2-3-1", resp.Documents[0].Fields["field1"].GetStringValue())
+	assert.NotNil(t, resp.Documents[0].CreateTime)
+
+	resp, err = srv.ListDocuments(ctx, &firestorepb.ListDocumentsRequest{
+		Parent:       parent,
+		CollectionId: "collection-2",
+		ShowMissing:  true,
+	})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Documents, 3)
+	assert.Equal(t, parent+"/collection-2/document-2-5", resp.Documents[2].Name)
+	assert.Nil(t, resp.Documents[2].CreateTime)
+	assert.Len(t, resp.Documents[2].Fields, 0)
+
+	// paging, ordering and masks
+	resp, err = srv.ListDocuments(ctx, &firestorepb.ListDocumentsRequest{
+		Parent:       parent,
+		CollectionId: "collection-2",
+		OrderBy:      "field3 desc",
+		PageSize:     1,
+		Mask:         &firestorepb.DocumentMask{FieldPaths: []string{"field3"}},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Documents, 1)
+	assert.Equal(t, parent+"/collection-2/document-2-4", resp.Documents[0].Name)
+	assert.Equal(t, 243.0, resp.Documents[0].Fields["field3"].GetDoubleValue())
+	assert.Len(t, resp.Documents[0].Fields, 1)
+	assert.NotEmpty(t, resp.NextPageToken)
+
+	resp, err = srv.ListDocuments(ctx, &firestorepb.ListDocumentsRequest{
+		Parent:       parent,
+		CollectionId: "collection-2",
+		OrderBy:      "field3 desc",
+		PageSize:     1,
+		PageToken:    resp.NextPageToken,
+	})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Documents, 1)
+	assert.Equal(t, parent+"/collection-2/document-2-3", resp.Documents[0].Name)
+	assert.Empty(t, resp.NextPageToken)
+
+	_, err = srv.ListDocuments(ctx, &firestorepb.ListDocumentsRequest{
+		Parent:       parent,
+		CollectionId: "collection-2",
+		PageToken:    "invalid",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = srv.ListDocuments(ctx, &firestorepb.ListDocumentsRequest{
+		Parent:       parent,
+		CollectionId: "collection-2",
+		OrderBy:      "field3",
+		ShowMissing:  true,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientListCollectionIds(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// collection-3 only contains a document that doesn't exist
+	_, err = client.Doc("collection-3/document-3-1/subcollection-3-1/subdocument-3-1-1").Set(ctx, map[string]interface{}{
+		"field1": "value-3-1-1-1",
+	})
+	assert.Nil(t, err)
+
+	collectionRefs, err := client.Collections(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, collectionRefs, 3)
+	assert.Equal(t, "collection-1", collectionRefs[0].ID)
+	assert.Equal(t, "collection-2", collectionRefs[1].ID)
+	assert.Equal(t, "collection-3", collectionRefs[2].ID)
+
+	collectionRefs, err = client.Doc("collection-2/document-2-4").Collections(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, collectionRefs, 1)
+	assert.Equal(t, "subcollection-2-4", collectionRefs[0].ID)
+
+	collectionRefs, err = client.Doc("collection-3/document-3-1").Collections(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, collectionRefs, 1)
+	assert.Equal(t, "subcollection-3-1", collectionRefs[0].ID)
+
+	collectionRefs, err = client.Doc("collection-1/document-1-1").Collections(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, collectionRefs, 0)
+
+	collectionRefs, err = client.Doc("collection-1/nonexistent").Collections(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, collectionRefs, 0)
+
+	// deleting the only document of a collection removes the collection
+	_, err = client.Doc("collection-3/document-3-1/subcollection-3-1/subdocument-3-1-1").Delete(ctx)
+	assert.Nil(t, err)
+	collectionRefs, err = client.Collections(ctx).GetAll()
+	assert.Nil(t, err)
+	assert.Len(t, collectionRefs, 2)
+
+	// paging
+	parent := "projects/projectID/databases/(default)/documents"
+	resp, err := srv.ListCollectionIds(ctx, &firestorepb.ListCollectionIdsRequest{
+		Parent:   parent,
+		PageSize: 1,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"collection-1"}, resp.CollectionIds)
+	assert.NotEmpty(t, resp.NextPageToken)
+
+	resp, err = srv.ListCollectionIds(ctx, &firestorepb.ListCollectionIdsRequest{
+		Parent:    parent,
+		PageSize:  1,
+		PageToken: resp.NextPageToken,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"collection-2"}, resp.CollectionIds)
+	assert.Empty(t, resp.NextPageToken)
+
+	_, err = srv.ListCollectionIds(ctx, &firestorepb.ListCollectionIdsRequest{
+		Parent:    parent,
+		PageToken: "invalid",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientBulkWriter(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	bw := client.BulkWriter(ctx)
+	createJob, err := bw.Create(client.Doc("collection-3/document-3-1"), map[string]interface{}{
+		"field1": "value-3-1-1",
+	})
+	assert.Nil(t, err)
+	existsJob, err := bw.Create(client.Doc("collection-1/document-1-1"), map[string]interface{}{
+		"field1": "value-1-1-1",
+	})
+	assert.Nil(t, err)
+	updateJob, err := bw.Update(client.Doc("collection-1/document-1-2"), []firestore.Update{
+		{Path: "field1", Value: "updated"},
+	})
+	assert.Nil(t, err)
+	missingJob, err := bw.Update(client.Doc("collection-1/nonexistent"), []firestore.Update{
+		{Path: "field1", Value: "updated"},
+	})
+	assert.Nil(t, err)
+	deleteJob, err := bw.Delete(client.Doc("collection-2/document-2-3"))
+	assert.Nil(t, err)
+	bw.End()
+
+	// each write succeeds or fails on its own
+	_, err = createJob.Results()
+	assert.Nil(t, err)
+	_, err = existsJob.Results()
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = updateJob.Results()
+	assert.Nil(t, err)
+	_, err = missingJob.Results()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = deleteJob.Results()
+	assert.Nil(t, err)
+
+	docSnap, err := client.Doc("collection-3/document-3-1").Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "value-3-1-1", docSnap.Data()["field1"])
+	docSnap, err = client.Doc("collection-1/document-1-2").Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "updated", docSnap.Data()["field1"])
+	_, err = client.Doc("collection-1/nonexistent").Get(ctx)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Doc("collection-2/document-2-3").Get(ctx)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// a document can only be written once per request
+	path := "projects/projectID/databases/(default)/documents/collection-1/document-1-1"
+	_, err = srv.BatchWrite(ctx, &firestorepb.BatchWriteRequest{
+		Writes: []*firestorepb.Write{
+			{Operation: &firestorepb.Write_Delete{Delete: path}},
+			{Operation: &firestorepb.Write_Delete{Delete: path}},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientPartitionQuery(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	// the parents are ordered differently by path segment than by string
+	paths := []string{}
+	for _, parent := range []string{"collection-1/document-1-1", "collection-1/document-1-2", "collection-2/document-2-4", "collection/document"} {
+		for i := 0; i < 5; i++ {
+			path := fmt.Sprintf("%s/comments/comment-%d", parent, i)
+			_, err = client.Doc(path).Set(ctx, map[string]interface{}{
+				"field1": float64(i),
+			})
+			assert.Nil(t, err)
+			paths = append(paths, path)
+		}
+	}
+
+	for _, partitionCount := range []int{1, 3, 7, 20, 50} {
+		partitions, err := client.CollectionGroup("comments").GetPartitionedQueries(ctx, partitionCount)
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, len(partitions), partitionCount)
+
+		// every document is in exactly one partition
+		found := map[string]int{}
+		for _, partition := range partitions {
+			docSnaps, err := partition.Documents(ctx).GetAll()
+			assert.Nil(t, err)
+			for _, docSnap := range docSnaps {
+				found[strings.TrimPrefix(docSnap.Ref.Path, "projects/projectID/databases/(default)/documents/")]++
+			}
+		}
+		assert.Len(t, found, len(paths))
+		for _, path := range paths {
+			assert.Equal(t, 1, found[path], path)
+		}
+	}
+
+	// paging
+	query := &firestorepb.StructuredQuery{
+		From: []*firestorepb.StructuredQuery_CollectionSelector{{CollectionId: "comments", AllDescendants: true}},
+		OrderBy: []*firestorepb.StructuredQuery_Order{{
+			Field:     &firestorepb.StructuredQuery_FieldReference{FieldPath: "__name__"},
+			Direction: firestorepb.StructuredQuery_ASCENDING,
+		}},
+	}
+	parent := "projects/projectID/databases/(default)/documents"
+	resp, err := srv.PartitionQuery(ctx, &firestorepb.PartitionQueryRequest{
+		Parent:         parent,
+		QueryType:      &firestorepb.PartitionQueryRequest_StructuredQuery{StructuredQuery: query},
+		PartitionCount: 4,
+		PageSize:       2,
+	})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Partitions, 2)
+	assert.Equal(t, parent+"/collection-1/document-1-1/comments/comment-0", resp.Partitions[0].Values[0].GetReferenceValue())
+	assert.NotEmpty(t, resp.NextPageToken)
+
+	resp, err = srv.PartitionQuery(ctx, &firestorepb.PartitionQueryRequest{
+		Parent:         parent,
+		QueryType:      &firestorepb.PartitionQueryRequest_StructuredQuery{StructuredQuery: query},
+		PartitionCount: 4,
+		PageSize:       2,
+		PageToken:      resp.NextPageToken,
+	})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Partitions, 1)
+	assert.Empty(t, resp.NextPageToken)
+
+	// only collection group queries ordered by name can be partitioned
+	query.From[0].AllDescendants = false
+	_, err = srv.PartitionQuery(ctx, &firestorepb.PartitionQueryRequest{
+		Parent:         parent,
+		QueryType:      &firestorepb.PartitionQueryRequest_StructuredQuery{StructuredQuery: query},
+		PartitionCount: 4,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	query.From[0].AllDescendants = true
+	query.Limit = &wrapperspb.Int32Value{Value: 1}
+	_, err = srv.PartitionQuery(ctx, &firestorepb.PartitionQueryRequest{
+		Parent:         parent,
+		QueryType:      &firestorepb.PartitionQueryRequest_StructuredQuery{StructuredQuery: query},
+		PartitionCount: 4,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientGetAll(t *testing.T) {
+	ctx := context.Background()
+	client, srv, err := New()
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	docRefs := []*firestore.DocumentRef{
+		client.Doc("collection-1/document-1-1"),
+		client.Doc("collection-1/nonexistent"),
+		client.Doc("collection-2/document-2-3"),
+		client.Doc("nonexistent/nonexistent"),
+		client.Doc("collection-2/document-2-4"),
+	}
+
+	// missing documents don't end the results
+	docSnaps, err := client.GetAll(ctx, docRefs)
+	assert.Nil(t, err)
+	assert.Len(t, docSnaps, 5)
+	assert.True(t, docSnaps[0].Exists())
+	assert.False(t, docSnaps[1].Exists())
+	assert.True(t, docSnaps[2].Exists())
+	assert.False(t, docSnaps[3].Exists())
+	assert.True(t, docSnaps[4].Exists())
+	assert.Equal(t, "value-2-4-1", docSnaps[4].Data()["field1"])
+	assert.Equal(t, docSnaps[0].ReadTime, docSnaps[4].ReadTime)
+
+	// earlier versions of documents aren't kept, so reads at a time before a
+	// document changed fail
+	_, err = client.WithReadOptions(firestore.ReadTime(time.Now().Add(-time.Minute))).GetAll(ctx, docRefs)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	// WithReadOptions changes the client, so clear the read time
+	client.WithReadOptions(firestore.ReadTime(time.Time{}))
+
+	readTime := timestamppb.Now()
+	_, err = client.Doc("collection-1/document-1-2").Delete(ctx)
+	assert.Nil(t, err)
+	_, err = client.Doc("collection-2/document-2-3").Set(ctx, map[string]interface{}{
+		"field1": "updated",
+	})
+	assert.Nil(t, err)
+
+	for _, test := range []struct {
+		path string
+		code codes.Code
+	}{
+		{"collection-1/document-1-1", codes.OK},
+		{"collection-1/nonexistent", codes.OK},
+		{"collection-1/document-1-2", codes.FailedPrecondition},
+		{"collection-2/document-2-3", codes.FailedPrecondition},
+	} {
+		stream := &batchGetDocumentsStream{ctx: ctx}
+		err = srv.BatchGetDocuments(&firestorepb.BatchGetDocumentsRequest{
+			Documents:           []string{"projects/projectID/databases/(default)/documents/" + test.path},
+			ConsistencySelector: &firestorepb.BatchGetDocumentsRequest_ReadTime{ReadTime: readTime},
+		}, stream)
+		assert.Equal(t, test.code, status.Code(err), test.path)
+		if err == nil {
+			assert.Len(t, stream.responses, 1)
+			assert.True(t, readTime.AsTime().Equal(stream.responses[0].GetReadTime().AsTime()))
+		}
+	}
+
+	// missing documents read in a transaction are recorded, so creating one
+	// before the transaction commits makes it retry
+	attempts := 0
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		attempts++
+		docSnaps, err := tx.GetAll(docRefs)
+		if err != nil {
+			return err
+		}
+		assert.Len(t, docSnaps, 5)
+		if attempts == 1 {
+			_, err = docRefs[3].Set(ctx, map[string]interface{}{
+				"field1": "concurrent-value",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Set(docRefs[1], map[string]interface{}{
+			"field1": "value-1-x-1",
+		})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	docSnap, err := docRefs[1].Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "value-1-x-1", docSnap.Data()["field1"])
+
+	// masks and new transactions
+	docNames := []string{
+		"projects/projectID/databases/(default)/documents/collection-1/document-1-1",
+		"projects/projectID/databases/(default)/documents/collection-1/document-1-2",
+	}
+	stream := &batchGetDocumentsStream{ctx: ctx}
+	err = srv.BatchGetDocuments(&firestorepb.BatchGetDocumentsRequest{
+		Documents: docNames,
+		Mask:      &firestorepb.DocumentMask{FieldPaths: []string{"field1", "field7.subfield1"}},
+		ConsistencySelector: &firestorepb.BatchGetDocumentsRequest_NewTransaction{
+			NewTransaction: &firestorepb.TransactionOptions{
+				Mode: &firestorepb.TransactionOptions_ReadOnly_{ReadOnly: &firestorepb.TransactionOptions_ReadOnly{}},
+			},
+		},
+	}, stream)
+	assert.Nil(t, err)
+	assert.Len(t, stream.responses, 2)
+	assert.NotEmpty(t, stream.responses[0].Transaction)
+	assert.Empty(t, stream.responses[1].Transaction)
+	fields := stream.responses[0].GetFound().GetFields()
+	assert.Len(t, fields, 2)
+	assert.Equal(t, "value-1-1-1", fields["field1"].GetStringValue())
+	assert.Len(t, fields["field7"].GetMapValue().GetFields(), 1)
+
+	// the new transaction can be used by later reads
+	transaction := stream.responses[0].GetTransaction()
+	stream = &batchGetDocumentsStream{ctx: ctx}
+	err = srv.BatchGetDocuments(&firestorepb.BatchGetDocumentsRequest{
+		Documents: docNames,
+		ConsistencySelector: &firestorepb.BatchGetDocumentsRequest_Transaction{
+			Transaction: transaction,
+		},
+	}, stream)
+	assert.Nil(t, err)
+	assert.Len(t, stream.responses, 2)
+	assert.Len(t, stream.responses[0].GetFound().GetFields(), 9)
+}
+
+// batchGetDocumentsStream records the responses of a BatchGetDocuments call.
+type batchGetDocumentsStream struct {
+	firestorepb.Firestore_BatchGetDocumentsServer
+	ctx       context.Context
+	responses []*firestorepb.BatchGetDocumentsResponse
+}
+
+func (s *batchGetDocumentsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *batchGetDocumentsStream) Send(response *firestorepb.BatchGetDocumentsResponse) error {
+	s.responses = append(s.responses, response)
+	return nil
+}
@@ -1,12 +1,17 @@
 package firestarter
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -14,18 +19,36 @@ type Collection struct {
 	documents map[string]*Document
 }
 
+// missingVersion is the version of a document that doesn't exist
+const missingVersion = -1
+
+// Reference is a reference to a document, stored as the document's full
+// resource name.
+type Reference string
+
 type Document struct {
 	name           string
 	subcollections map[string]Collection
 	fields         map[string]interface{}
+	// exists is false for documents that are only present because they have
+	// subcollections
+	exists bool
+	// version is the server version of the last commit to write the document
+	version    int64
+	createTime time.Time
+	updateTime time.Time
 }
 
 func valueToProtoValue(value interface{}) *pb.Value {
 	switch v := value.(type) {
+	case nil:
+		return &pb.Value{ValueType: &pb.Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}}
 	case string:
 		return &pb.Value{ValueType: &pb.Value_StringValue{StringValue: v}}
 	case int:
 		return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: int64(v)}}
+	case int64:
+		return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: v}}
 	case float64:
 		return &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: v}}
 	case bool:
@@ -34,6 +57,12 @@ func valueToProtoValue(value interface{}) *pb.Value {
 		return &pb.Value{ValueType: &pb.Value_TimestampValue{TimestampValue: timestamppb.New(v)}}
 	case []byte:
 		return &pb.Value{ValueType: &pb.Value_BytesValue{BytesValue: v}}
+	case Reference:
+		return &pb.Value{ValueType: &pb.Value_ReferenceValue{ReferenceValue: string(v)}}
+	case *latlng.LatLng:
+		return &pb.Value{ValueType: &pb.Value_GeoPointValue{GeoPointValue: &latlng.LatLng{Latitude: v.Latitude, Longitude: v.Longitude}}}
+	case Vector:
+		return v.toProto()
 	case map[string]interface{}:
 		return &pb.Value{ValueType: &pb.Value_MapValue{MapValue: &pb.MapValue{Fields: mapToFields(v)}}}
 	case []interface{}:
@@ -55,26 +84,41 @@ func mapToFields(mapvals map[string]interface{}) map[string]*pb.Value {
 	return fields
 }
 
+func protoValueToValue(value *pb.Value) interface{} {
+	switch v := value.GetValueType().(type) {
+	case *pb.Value_StringValue:
+		return v.StringValue
+	case *pb.Value_IntegerValue:
+		return v.IntegerValue
+	case *pb.Value_DoubleValue:
+		return v.DoubleValue
+	case *pb.Value_BooleanValue:
+		return v.BooleanValue
+	case *pb.Value_TimestampValue:
+		return v.TimestampValue.AsTime()
+	case *pb.Value_BytesValue:
+		return v.BytesValue
+	case *pb.Value_ReferenceValue:
+		return Reference(v.ReferenceValue)
+	case *pb.Value_GeoPointValue:
+		return &latlng.LatLng{Latitude: v.GeoPointValue.GetLatitude(), Longitude: v.GeoPointValue.GetLongitude()}
+	case *pb.Value_MapValue:
+		m := pbMapToMap(v.MapValue.Fields)
+		if vector, ok := mapToVector(m); ok {
+			return vector
+		}
+		return m
+	case *pb.Value_ArrayValue:
+		return pbArrayToSlice(v.ArrayValue.Values)
+	}
+	return nil
+}
+
 func pbMapToMap(mapvals map[string]*pb.Value) map[string]interface{} {
 	fields := map[string]interface{}{}
 	for key, value := range mapvals {
-		switch v := value.GetValueType().(type) {
-		case *pb.Value_StringValue:
-			fields[key] = v.StringValue
-		case *pb.Value_IntegerValue:
-			fields[key] = v.IntegerValue
-		case *pb.Value_DoubleValue:
-			fields[key] = v.DoubleValue
-		case *pb.Value_BooleanValue:
-			fields[key] = v.BooleanValue
-		case *pb.Value_TimestampValue:
-			fields[key] = v.TimestampValue.AsTime()
-		case *pb.Value_BytesValue:
-			fields[key] = v.BytesValue
-		case *pb.Value_MapValue:
-			fields[key] = pbMapToMap(v.MapValue.Fields)
-		case *pb.Value_ArrayValue:
-			fields[key] = pbArrayToSlice(v.ArrayValue.Values)
+		if v := protoValueToValue(value); v != nil || isNullValue(value) {
+			fields[key] = v
 		}
 	}
 	return fields
@@ -83,34 +127,105 @@ func pbMapToMap(mapvals map[string]*pb.Value) map[string]interface{} {
 func pbArrayToSlice(arrayvals []*pb.Value) []interface{} {
 	slice := []interface{}{}
 	for _, value := range arrayvals {
-		switch v := value.GetValueType().(type) {
-		case *pb.Value_StringValue:
-			slice = append(slice, v.StringValue)
-		case *pb.Value_IntegerValue:
-			slice = append(slice, v.IntegerValue)
-		case *pb.Value_DoubleValue:
-			slice = append(slice, v.DoubleValue)
-		case *pb.Value_BooleanValue:
-			slice = append(slice, v.BooleanValue)
-		case *pb.Value_TimestampValue:
-			slice = append(slice, v.TimestampValue.AsTime())
-		case *pb.Value_BytesValue:
-			slice = append(slice, v.BytesValue)
-		case *pb.Value_MapValue:
-			slice = append(slice, pbMapToMap(v.MapValue.Fields))
-		case *pb.Value_ArrayValue:
-			slice = append(slice, pbArrayToSlice(v.ArrayValue.Values))
+		if v := protoValueToValue(value); v != nil || isNullValue(value) {
+			slice = append(slice, v)
 		}
 	}
 	return slice
 }
 
+// isNullValue returns whether the value is null. Null values are stored as nil,
+// which protoValueToValue also returns for unsupported values.
+func isNullValue(value *pb.Value) bool {
+	_, ok := value.GetValueType().(*pb.Value_NullValue)
+	return ok
+}
+
+// equalValues compares two values the way Firestore does, so 1 and 1.0 are
+// equal and NaN is equal to NaN.
+func equalValues(a, b interface{}) bool {
+	if isNumber(a) && isNumber(b) {
+		return compareNumbers(a, b) == 0
+	}
+
+	switch av := a.(type) {
+	case time.Time:
+		bv, ok := b.(time.Time)
+		return ok && av.Equal(bv)
+	case []byte:
+		bv, ok := b.([]byte)
+		return ok && bytes.Equal(av, bv)
+	case *latlng.LatLng:
+		bv, ok := b.(*latlng.LatLng)
+		return ok && av.GetLatitude() == bv.GetLatitude() && av.GetLongitude() == bv.GetLongitude()
+	case Vector:
+		bv, ok := b.(Vector)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if av[i] != bv[i] {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key, value := range av {
+			other, ok := bv[key]
+			if !ok || !equalValues(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equalValues(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// parseFieldPath splits a field path into its segments. Segments are separated
+// by dots and segments that aren't simple identifiers are quoted with
+// backticks, e.g. "a.`b.c`.d" is ["a", "b.c", "d"].
+func parseFieldPath(path string) []string {
+	parts := []string{}
+	var part strings.Builder
+	quoted := false
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '\\' && quoted && i+1 < len(path):
+			i++
+			part.WriteByte(path[i])
+		case c == '`':
+			quoted = !quoted
+		case c == '.' && !quoted:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(c)
+		}
+	}
+	return append(parts, part.String())
+}
+
 func (d *Document) ToProto(fullPath string) *pb.Document {
-	aTimestamp := timestamppb.Now()
 	doc := &pb.Document{
 		Name:       fullPath,
-		CreateTime: aTimestamp,
-		UpdateTime: aTimestamp,
+		CreateTime: timestamppb.New(d.createTime),
+		UpdateTime: timestamppb.New(d.updateTime),
 		Fields:     mapToFields(d.fields),
 	}
 
@@ -118,22 +233,83 @@ func (d *Document) ToProto(fullPath string) *pb.Document {
 }
 
 func (d *Document) Get(name string) interface{} {
-	parts := strings.Split(name, ".")
+	value, _ := d.GetPath(parseFieldPath(name))
+	return value
+}
 
+// GetPath returns the value at the field path and whether it exists.
+func (d *Document) GetPath(path []string) (interface{}, bool) {
+	var value interface{} = d.fields
+	for _, part := range path {
+		current, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = current[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// SetPath sets the value at the field path, replacing anything that isn't a
+// map along the way.
+func (d *Document) SetPath(path []string, value interface{}) {
 	current := d.fields
-	for _, part := range parts {
-		if current[part] == nil {
-			return nil
-		}
-		value := current[part]
-		switch v := value.(type) {
-		case map[string]interface{}:
-			current = v
-		default:
-			return value
+	for _, part := range path[:len(path)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			current[part] = next
 		}
+		current = next
 	}
-	return current
+	current[path[len(path)-1]] = value
+}
+
+// DeletePath removes the value at the field path.
+func (d *Document) DeletePath(path []string) {
+	current := d.fields
+	for _, part := range path[:len(path)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		current = next
+	}
+	delete(current, path[len(path)-1])
+}
+
+// clone returns a copy of the document without its subcollections.
+func (d *Document) clone() *Document {
+	return &Document{
+		name:       d.name,
+		fields:     copyValue(d.fields).(map[string]interface{}),
+		exists:     d.exists,
+		version:    d.version,
+		createTime: d.createTime,
+		updateTime: d.updateTime,
+	}
+}
+
+// copyValue returns a deep copy of the maps and arrays within value.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[key] = copyValue(val)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, val := range v {
+			a[i] = copyValue(val)
+		}
+		return a
+	}
+	return value
 }
 
 func (d *Document) Clear() {
@@ -141,27 +317,38 @@ func (d *Document) Clear() {
 }
 
 func (d *Document) SetWithValue(name string, value *pb.Value) {
-	switch value := value.GetValueType().(type) {
-	case *pb.Value_IntegerValue:
-		d.fields[name] = value.IntegerValue
-	case *pb.Value_DoubleValue:
-		d.fields[name] = value.DoubleValue
-	case *pb.Value_TimestampValue:
-		d.fields[name] = value.TimestampValue.AsTime()
-	case *pb.Value_StringValue:
-		d.fields[name] = value.StringValue
-	case *pb.Value_BooleanValue:
-		d.fields[name] = value.BooleanValue
-	case *pb.Value_BytesValue:
-		d.fields[name] = value.BytesValue
-	case *pb.Value_MapValue:
-		d.fields[name] = pbMapToMap(value.MapValue.Fields)
-	case *pb.Value_ArrayValue:
-		d.fields[name] = pbArrayToSlice(value.ArrayValue.Values)
+	if v := protoValueToValue(value); v != nil || isNullValue(value) {
+		d.fields[name] = v
+	}
+}
+
+// documentNamePattern matches the full resource name of a document.
+var documentNamePattern = regexp.MustCompile(`^projects/[^/]+/databases/[^/]+/documents/[^/]+/[^/]+(/[^/]+/[^/]+)*$`)
+
+// parseGeoURI parses a geo URI (RFC 5870) such as "geo:37.7749,-122.4194" into
+// a geographical point. The altitude and URI parameters are ignored.
+func parseGeoURI(str string) (*latlng.LatLng, bool) {
+	coordinates, found := strings.CutPrefix(str, "geo:")
+	if !found {
+		return nil, false
+	}
+	coordinates, _, _ = strings.Cut(coordinates, ";")
+	parts := strings.Split(coordinates, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, false
+	}
+	latitude, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		return nil, false
 	}
+	longitude, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		return nil, false
+	}
+	return &latlng.LatLng{Latitude: latitude, Longitude: longitude}, true
 }
 
-func parseCollection(path string, collectionData map[string]interface{}) (*Collection, error) {
+func parseCollection(path string, collectionData map[string]interface{}, version int64, loadTime time.Time) (*Collection, error) {
 	collection := Collection{
 		documents: map[string]*Document{},
 	}
@@ -171,7 +358,7 @@ func parseCollection(path string, collectionData map[string]interface{}) (*Colle
 		if !ok {
 			return nil, fmt.Errorf("document %v data is not a map: %v", documentName, documentData)
 		}
-		newDoc, err := parseDocument(path+"/"+documentName, ddata)
+		newDoc, err := parseDocument(path+"/"+documentName, ddata, version, loadTime)
 		if err != nil {
 			return nil, err
 		}
@@ -184,11 +371,15 @@ func parseCollection(path string, collectionData map[string]interface{}) (*Colle
 	return &collection, nil
 }
 
-func parseDocument(path string, documentData map[string]interface{}) (*Document, error) {
+func parseDocument(path string, documentData map[string]interface{}, version int64, loadTime time.Time) (*Document, error) {
 	newDoc := Document{
 		name:           path,
 		subcollections: map[string]Collection{},
 		fields:         map[string]interface{}{},
+		exists:         true,
+		version:        version,
+		createTime:     loadTime,
+		updateTime:     loadTime,
 	}
 
 	for key, value := range documentData {
@@ -202,7 +393,7 @@ func parseDocument(path string, documentData map[string]interface{}) (*Document,
 				if !ok {
 					return nil, fmt.Errorf("collection %v data is not a map: %v", collectionName, collectionData)
 				}
-				newCollection, err := parseCollection(path+"/"+collectionName, cdata)
+				newCollection, err := parseCollection(path+"/"+collectionName, cdata, version, loadTime)
 				if err != nil {
 					return nil, err
 				}
@@ -214,6 +405,10 @@ func parseDocument(path string, documentData map[string]interface{}) (*Document,
 				t, err := time.Parse(time.RFC3339, str)
 				if err == nil {
 					value = t
+				} else if point, ok := parseGeoURI(str); ok {
+					value = point
+				} else if documentNamePattern.MatchString(str) {
+					value = Reference(str)
 				} else {
 					if strings.HasPrefix(str, "data:") {
 						// suppport for data URIs
@@ -228,6 +423,10 @@ func parseDocument(path string, documentData map[string]interface{}) (*Document,
 						}
 					}
 				}
+			} else if m, ok := value.(map[string]interface{}); ok {
+				if vector, ok := mapToVector(m); ok {
+					value = vector
+				}
 			}
 			newDoc.fields[key] = value
 		}
@@ -3,7 +3,8 @@ package firestarter
 import (
 	"time"
 
-	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/genproto/googleapis/type/latlng"
 )
 
 func matchFilter(doc Document, where *pb.StructuredQuery_Filter) bool {
@@ -19,37 +20,25 @@ func matchFilter(doc Document, where *pb.StructuredQuery_Filter) bool {
 		return matchFieldFilter(doc, where.GetFieldFilter())
 	}
 
+	if where.GetUnaryFilter() != nil {
+		return matchUnaryFilter(doc, where.GetUnaryFilter())
+	}
+
 	return false
 }
 
 func matchCompositeFilter(doc Document, filter *pb.StructuredQuery_CompositeFilter) bool {
 	if filter.GetOp() == pb.StructuredQuery_CompositeFilter_AND {
 		for _, filter := range filter.GetFilters() {
-			if filter.GetCompositeFilter() != nil {
-				if !matchCompositeFilter(doc, filter.GetCompositeFilter()) {
-					return false
-				}
-			}
-
-			if filter.GetFieldFilter() != nil {
-				if !matchFieldFilter(doc, filter.GetFieldFilter()) {
-					return false
-				}
+			if !matchFilter(doc, filter) {
+				return false
 			}
 		}
 		return true
-	} else if filter.GetOp() == 2 { // OR but not defined in this version of our import
+	} else if filter.GetOp() == pb.StructuredQuery_CompositeFilter_OR {
 		for _, filter := range filter.GetFilters() {
-			if filter.GetCompositeFilter() != nil {
-				if matchCompositeFilter(doc, filter.GetCompositeFilter()) {
-					return true
-				}
-			}
-
-			if filter.GetFieldFilter() != nil {
-				if matchFieldFilter(doc, filter.GetFieldFilter()) {
-					return true
-				}
+			if matchFilter(doc, filter) {
+				return true
 			}
 		}
 		return false
@@ -62,21 +51,74 @@ func matchFieldFilter(doc Document, filter *pb.StructuredQuery_FieldFilter) bool
 	value := filter.GetValue()
 	op := filter.GetOp()
 
-	v := doc.Get(field)
-	if v == nil {
+	v, ok := doc.GetPath(parseFieldPath(field))
+	if !ok {
 		return false
 	}
 
 	return matchValue(v, op, value)
 }
 
+// matchUnaryFilter matches null and NaN values. Like other filters, the
+// negated operators only match documents that have the field, and IS_NOT_NAN
+// doesn't match null values.
+func matchUnaryFilter(doc Document, filter *pb.StructuredQuery_UnaryFilter) bool {
+	v, ok := doc.GetPath(parseFieldPath(filter.GetField().GetFieldPath()))
+	if !ok {
+		return false
+	}
+
+	switch filter.GetOp() {
+	case pb.StructuredQuery_UnaryFilter_IS_NULL:
+		return v == nil
+	case pb.StructuredQuery_UnaryFilter_IS_NOT_NULL:
+		return v != nil
+	case pb.StructuredQuery_UnaryFilter_IS_NAN:
+		return isNaN(v)
+	case pb.StructuredQuery_UnaryFilter_IS_NOT_NAN:
+		return v != nil && !isNaN(v)
+	}
+	return false
+}
+
 func matchValue(value interface{}, op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
+	switch op {
+	case pb.StructuredQuery_FieldFilter_IN:
+		for _, ref := range filterValue.GetArrayValue().Values {
+			if matchValue(value, pb.StructuredQuery_FieldFilter_EQUAL, ref) {
+				return true
+			}
+		}
+		return false
+	case pb.StructuredQuery_FieldFilter_NOT_IN:
+		if value == nil {
+			return false
+		}
+		for _, ref := range filterValue.GetArrayValue().Values {
+			if matchValue(value, pb.StructuredQuery_FieldFilter_EQUAL, ref) {
+				return false
+			}
+		}
+		return true
+	case pb.StructuredQuery_FieldFilter_EQUAL,
+		pb.StructuredQuery_FieldFilter_NOT_EQUAL,
+		pb.StructuredQuery_FieldFilter_LESS_THAN,
+		pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL,
+		pb.StructuredQuery_FieldFilter_GREATER_THAN,
+		pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+		// values of different types are never equal, and range filters only
+		// match values of the same type
+		if value != nil && typeOrder(value) != typeOrder(protoValueToValue(filterValue)) {
+			return op == pb.StructuredQuery_FieldFilter_NOT_EQUAL
+		}
+	}
+
 	switch v := value.(type) {
+	case nil:
+		return matchNullValue(op, filterValue)
 	case string:
 		return matchStringValue(v, op, filterValue)
-	case int:
-		return matchNumberValue(v, op, filterValue)
-	case float64:
+	case int64, float64:
 		return matchNumberValue(v, op, filterValue)
 	case bool:
 		return matchBoolValue(v, op, filterValue)
@@ -84,6 +126,12 @@ func matchValue(value interface{}, op pb.StructuredQuery_FieldFilter_Operator, f
 		return matchTimeValue(v, op, filterValue)
 	case []byte:
 		return matchBytesValue(v, op, filterValue)
+	case Reference:
+		return matchReferenceValue(v, op, filterValue)
+	case *latlng.LatLng:
+		return matchGeoPointValue(v, op, filterValue)
+	case Vector:
+		return matchVectorValue(v, op, filterValue)
 	case map[string]interface{}:
 		return matchMapValue(v, op, filterValue)
 	case []interface{}:
@@ -92,6 +140,12 @@ func matchValue(value interface{}, op pb.StructuredQuery_FieldFilter_Operator, f
 	return false
 }
 
+// matchNullValue matches a null value. Null only equals null, and like missing
+// fields, null values never match NOT_EQUAL or NOT_IN.
+func matchNullValue(op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
+	return op == pb.StructuredQuery_FieldFilter_EQUAL && isNullValue(filterValue)
+}
+
 func matchStringValue(value string, op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
 	switch op {
 	case pb.StructuredQuery_FieldFilter_EQUAL:
@@ -106,114 +160,38 @@ func matchStringValue(value string, op pb.StructuredQuery_FieldFilter_Operator,
 		return value >= filterValue.GetStringValue()
 	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
 		return value != filterValue.GetStringValue()
-	case pb.StructuredQuery_FieldFilter_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value == ref.GetStringValue() {
-				return true
-			}
-		}
-	case pb.StructuredQuery_FieldFilter_NOT_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value == ref.GetStringValue() {
-				return false
-			}
-		}
-		return true
 	}
 	return false
 }
 
-func filterValueAsInt64(value *pb.Value) int64 {
-	switch value := value.GetValueType().(type) {
-	case *pb.Value_IntegerValue:
-		return value.IntegerValue
-	case *pb.Value_DoubleValue:
-		return int64(value.DoubleValue)
-	}
-	return 0
-}
-
-func filterValueAsFloat64(value *pb.Value) float64 {
-	switch value := value.GetValueType().(type) {
-	case *pb.Value_IntegerValue:
-		return float64(value.IntegerValue)
-	case *pb.Value_DoubleValue:
-		return value.DoubleValue
-	}
-	return 0
-}
-
 func matchNumberValue(value interface{}, op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
-	// if value is int64, convert filterValue to int64
-	// if value is float64, convert filterValue to float64
-
-	switch v := value.(type) {
-	case int64:
-		return matchIntValue(v, op, filterValue)
-	case float64:
-		return matchDoubleValue(v, op, filterValue)
-	}
-	return false
-}
-
-func matchIntValue(value int64, op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
-	switch op {
-	case pb.StructuredQuery_FieldFilter_EQUAL:
-		return value == filterValueAsInt64(filterValue)
-	case pb.StructuredQuery_FieldFilter_LESS_THAN:
-		return value < filterValueAsInt64(filterValue)
-	case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
-		return value <= filterValueAsInt64(filterValue)
-	case pb.StructuredQuery_FieldFilter_GREATER_THAN:
-		return value > filterValueAsInt64(filterValue)
-	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
-		return value >= filterValueAsInt64(filterValue)
-	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
-		return value != filterValueAsInt64(filterValue)
-	case pb.StructuredQuery_FieldFilter_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value == filterValueAsInt64(ref) {
-				return true
-			}
+	// integers and doubles are compared numerically
+	other := protoValueToValue(filterValue)
+	if isNaN(value) || isNaN(other) {
+		// NaN is only equal to NaN and isn't in any range
+		switch op {
+		case pb.StructuredQuery_FieldFilter_EQUAL:
+			return isNaN(value) && isNaN(other)
+		case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
+			return !(isNaN(value) && isNaN(other))
 		}
-	case pb.StructuredQuery_FieldFilter_NOT_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value == filterValueAsInt64(ref) {
-				return false
-			}
-		}
-		return true
+		return false
 	}
-	return false
-}
 
-func matchDoubleValue(value float64, op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
+	c := compareNumbers(value, other)
 	switch op {
 	case pb.StructuredQuery_FieldFilter_EQUAL:
-		return value == filterValueAsFloat64(filterValue)
+		return c == 0
 	case pb.StructuredQuery_FieldFilter_LESS_THAN:
-		return value < filterValueAsFloat64(filterValue)
+		return c < 0
 	case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
-		return value <= filterValueAsFloat64(filterValue)
+		return c <= 0
 	case pb.StructuredQuery_FieldFilter_GREATER_THAN:
-		return value > filterValueAsFloat64(filterValue)
+		return c > 0
 	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
-		return value >= filterValueAsFloat64(filterValue)
+		return c >= 0
 	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
-		return value != filterValueAsFloat64(filterValue)
-	case pb.StructuredQuery_FieldFilter_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value == filterValueAsFloat64(ref) {
-				return true
-			}
-		}
-	case pb.StructuredQuery_FieldFilter_NOT_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value == filterValueAsFloat64(ref) {
-				return false
-			}
-		}
-		return true
+		return c != 0
 	}
 	return false
 }
@@ -224,19 +202,6 @@ func matchBoolValue(value bool, op pb.StructuredQuery_FieldFilter_Operator, filt
 		return value == filterValue.GetBooleanValue()
 	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
 		return value != filterValue.GetBooleanValue()
-	case pb.StructuredQuery_FieldFilter_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value == ref.GetBooleanValue() {
-				return true
-			}
-		}
-	case pb.StructuredQuery_FieldFilter_NOT_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value == ref.GetBooleanValue() {
-				return false
-			}
-		}
-		return true
 	}
 	return false
 }
@@ -255,19 +220,6 @@ func matchTimeValue(value time.Time, op pb.StructuredQuery_FieldFilter_Operator,
 		return value.After(filterValue.GetTimestampValue().AsTime()) || value.Equal(filterValue.GetTimestampValue().AsTime())
 	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
 		return !value.Equal(filterValue.GetTimestampValue().AsTime())
-	case pb.StructuredQuery_FieldFilter_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value.Equal(ref.GetTimestampValue().AsTime()) {
-				return true
-			}
-		}
-	case pb.StructuredQuery_FieldFilter_NOT_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if value.Equal(ref.GetTimestampValue().AsTime()) {
-				return false
-			}
-		}
-		return true
 	}
 	return false
 }
@@ -286,19 +238,60 @@ func matchBytesValue(value []byte, op pb.StructuredQuery_FieldFilter_Operator, f
 		return string(value) >= string(filterValue.GetBytesValue())
 	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
 		return string(value) != string(filterValue.GetBytesValue())
-	case pb.StructuredQuery_FieldFilter_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if string(value) == string(ref.GetBytesValue()) {
-				return true
-			}
-		}
-	case pb.StructuredQuery_FieldFilter_NOT_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if string(value) == string(ref.GetBytesValue()) {
-				return false
-			}
-		}
-		return true
+	}
+	return false
+}
+
+func matchReferenceValue(value Reference, op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
+	switch op {
+	case pb.StructuredQuery_FieldFilter_EQUAL:
+		return string(value) == filterValue.GetReferenceValue()
+	case pb.StructuredQuery_FieldFilter_LESS_THAN:
+		return string(value) < filterValue.GetReferenceValue()
+	case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+		return string(value) <= filterValue.GetReferenceValue()
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+		return string(value) > filterValue.GetReferenceValue()
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+		return string(value) >= filterValue.GetReferenceValue()
+	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
+		return string(value) != filterValue.GetReferenceValue()
+	}
+	return false
+}
+
+func matchGeoPointValue(value *latlng.LatLng, op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
+	switch op {
+	case pb.StructuredQuery_FieldFilter_EQUAL:
+		return equalValues(value, protoValueToValue(filterValue))
+	case pb.StructuredQuery_FieldFilter_LESS_THAN:
+		return lessThanVal(value, filterValue.GetGeoPointValue())
+	case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+		return !lessThanVal(filterValue.GetGeoPointValue(), value)
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+		return lessThanVal(filterValue.GetGeoPointValue(), value)
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+		return !lessThanVal(value, filterValue.GetGeoPointValue())
+	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
+		return !equalValues(value, protoValueToValue(filterValue))
+	}
+	return false
+}
+
+func matchVectorValue(value Vector, op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
+	switch op {
+	case pb.StructuredQuery_FieldFilter_EQUAL:
+		return equalValues(value, protoValueToValue(filterValue))
+	case pb.StructuredQuery_FieldFilter_LESS_THAN:
+		return lessThanVal(value, protoValueToValue(filterValue))
+	case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+		return !lessThanVal(protoValueToValue(filterValue), value)
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+		return lessThanVal(protoValueToValue(filterValue), value)
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+		return !lessThanVal(value, protoValueToValue(filterValue))
+	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
+		return !equalValues(value, protoValueToValue(filterValue))
 	}
 	return false
 }
@@ -317,6 +310,18 @@ func matchArrayValue(value []interface{}, op pb.StructuredQuery_FieldFilter_Oper
 				return true
 			}
 		}
+	case pb.StructuredQuery_FieldFilter_EQUAL:
+		return equalValues(value, protoValueToValue(filterValue))
+	case pb.StructuredQuery_FieldFilter_LESS_THAN:
+		return lessThanVal(value, protoValueToValue(filterValue))
+	case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+		return !lessThanVal(protoValueToValue(filterValue), value)
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+		return lessThanVal(protoValueToValue(filterValue), value)
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+		return !lessThanVal(value, protoValueToValue(filterValue))
+	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
+		return !equalValues(value, protoValueToValue(filterValue))
 	}
 	return false
 }
@@ -324,44 +329,17 @@ func matchArrayValue(value []interface{}, op pb.StructuredQuery_FieldFilter_Oper
 func matchMapValue(value map[string]interface{}, op pb.StructuredQuery_FieldFilter_Operator, filterValue *pb.Value) bool {
 	switch op {
 	case pb.StructuredQuery_FieldFilter_EQUAL:
-		return matchMapEqual(value, filterValue.GetMapValue().Fields)
+		return equalValues(value, protoValueToValue(filterValue))
 	case pb.StructuredQuery_FieldFilter_LESS_THAN:
-		return matchMapLessThan(value, filterValue.GetMapValue().Fields)
+		return lessThanVal(value, protoValueToValue(filterValue))
 	case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
-		return matchMapEqual(value, filterValue.GetMapValue().Fields) || matchMapLessThan(value, filterValue.GetMapValue().Fields)
+		return !lessThanVal(protoValueToValue(filterValue), value)
 	case pb.StructuredQuery_FieldFilter_GREATER_THAN:
-		return !matchMapEqual(value, filterValue.GetMapValue().Fields) && !matchMapLessThan(value, filterValue.GetMapValue().Fields)
+		return lessThanVal(protoValueToValue(filterValue), value)
 	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
-		return !matchMapLessThan(value, filterValue.GetMapValue().Fields)
+		return !lessThanVal(value, protoValueToValue(filterValue))
 	case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
-		return !matchMapEqual(value, filterValue.GetMapValue().Fields)
-	case pb.StructuredQuery_FieldFilter_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if matchMapEqual(value, ref.GetMapValue().Fields) {
-				return true
-			}
-		}
-	case pb.StructuredQuery_FieldFilter_NOT_IN:
-		for _, ref := range filterValue.GetArrayValue().Values {
-			if matchMapEqual(value, ref.GetMapValue().Fields) {
-				return false
-			}
-		}
-		return true
+		return !equalValues(value, protoValueToValue(filterValue))
 	}
 	return false
 }
-
-func matchMapEqual(value map[string]interface{}, filter map[string]*pb.Value) bool {
-	for key, filterValue := range filter {
-		if !matchValue(value[key], pb.StructuredQuery_FieldFilter_EQUAL, filterValue) {
-			return false
-		}
-	}
-	return true
-}
-
-func matchMapLessThan(value map[string]interface{}, filter map[string]*pb.Value) bool {
-	m := pbMapToMap(filter)
-	return lessThanVal(value, m)
-}
@@ -23,11 +23,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
 	"strings"
 	"time"
 
-	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/genproto/googleapis/type/latlng"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	empty "google.golang.org/protobuf/types/known/emptypb"
@@ -36,6 +39,9 @@ import (
 
 var ErrDocumentNotFound = status.Error(codes.NotFound, "document not found")
 var ErrCollectionNotFound = status.Error(codes.NotFound, "collection not found")
+var ErrDocumentAlreadyExists = status.Error(codes.AlreadyExists, "document already exists")
+var ErrUpdateTimeMismatch = status.Error(codes.FailedPrecondition, "document update time does not match the required update time")
+var ErrReadTimeTooOld = status.Error(codes.FailedPrecondition, "document changed after the read time, reads of earlier versions are not supported")
 
 func min(a, b int) int {
 	if a < b {
@@ -62,7 +68,44 @@ func stripPrefix(fullPath string) string {
 	return path
 }
 
+// documentsRoot returns the `projects/{project_id}/databases/{database_id}/documents`
+// prefix of fullPath.
+func documentsRoot(fullPath string) string {
+	parts := strings.Split(fullPath, "/")
+	if len(parts) < 5 {
+		return fullPath
+	}
+	return strings.Join(parts[:5], "/")
+}
+
 func (s *MockServer) getDocumentByPath(path string) (*Document, error) {
+	document, err := s.lookupDocument(path)
+	if err != nil {
+		return nil, err
+	}
+	if !document.exists {
+		return nil, ErrDocumentNotFound
+	}
+
+	return document, nil
+}
+
+// checkReadTime returns ErrReadTimeTooOld if the document at path was written
+// or deleted after readTime. Must be called with dataLock held.
+func (s *MockServer) checkReadTime(path string, readTime time.Time) error {
+	if s.resetTime.After(readTime) || s.deleteTimes[path].After(readTime) {
+		return ErrReadTimeTooOld
+	}
+	document, err := s.lookupDocument(path)
+	if err == nil && document.exists && document.updateTime.After(readTime) {
+		return ErrReadTimeTooOld
+	}
+	return nil
+}
+
+// lookupDocument returns the document at path, including documents that don't
+// exist but have subcollections.
+func (s *MockServer) lookupDocument(path string) (*Document, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
 		return nil, fmt.Errorf("invalid document path: %s", path)
@@ -93,6 +136,53 @@ func (s *MockServer) getDocumentByPath(path string) (*Document, error) {
 	return document, nil
 }
 
+// deleteDocument deletes the document at path. A document with subcollections
+// is kept, without fields, so its subcollections remain reachable. Documents
+// and collections left empty by the delete are removed.
+func (s *MockServer) deleteDocument(path string) error {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || len(parts)%2 != 0 {
+		return fmt.Errorf("invalid document path: %s", path)
+	}
+
+	// the chain of documents from the root to the deleted document
+	chain := []*Document{{
+		subcollections: s.data,
+	}}
+	for i := 0; i < len(parts); i += 2 {
+		collection, ok := chain[len(chain)-1].subcollections[parts[i]]
+		if !ok {
+			return nil
+		}
+		document, ok := collection.documents[parts[i+1]]
+		if !ok {
+			return nil
+		}
+		chain = append(chain, document)
+	}
+
+	document := chain[len(chain)-1]
+	document.exists = false
+	document.Clear()
+
+	for i := len(chain) - 1; i > 0; i-- {
+		document := chain[i]
+		if document.exists || len(document.subcollections) > 0 {
+			break
+		}
+		collectionId := parts[2*(i-1)]
+		documentId := parts[2*(i-1)+1]
+		parent := chain[i-1]
+		delete(parent.subcollections[collectionId].documents, documentId)
+		if len(parent.subcollections[collectionId].documents) > 0 {
+			break
+		}
+		delete(parent.subcollections, collectionId)
+	}
+
+	return nil
+}
+
 func (s *MockServer) getCollectionByPath(path string) (*Collection, error) {
 	path = stripPrefix(path)
 	parts := strings.Split(path, "/")
@@ -110,7 +200,7 @@ func (s *MockServer) getCollectionByPath(path string) (*Collection, error) {
 
 	if len(parts) > 0 {
 		var err error
-		document, err = s.getDocumentByPath(strings.Join(parts, "/"))
+		document, err = s.lookupDocument(strings.Join(parts, "/"))
 		if err != nil {
 			return nil, err
 		}
@@ -152,7 +242,7 @@ func (s *MockServer) newDocumentWithPath(path string) (*Document, error) {
 		d, ok = c.documents[documentId]
 		if !ok {
 			d = &Document{
-				name:           documentId,
+				name:           strings.Join(parts[:i+2], "/"),
 				subcollections: map[string]Collection{},
 				fields:         map[string]interface{}{},
 			}
@@ -173,6 +263,13 @@ func (s *MockServer) GetDocument(ctx context.Context, req *pb.GetDocumentRequest
 
 	// `projects/{project_id}/databases/{database_id}/documents/{document_path}`.
 	path := stripPrefix(req.GetName())
+	if len(req.GetTransaction()) > 0 {
+		tx, err := s.getTransaction(req.GetTransaction())
+		if err != nil {
+			return nil, err
+		}
+		s.recordRead(tx, path)
+	}
 	document, err := s.getDocumentByPath(path)
 	if err != nil {
 		return nil, err
@@ -188,54 +285,94 @@ func (s *MockServer) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.Com
 
 	writes := req.GetWrites()
 
-	responses := []*pb.WriteResult{}
-
-	for _, write := range writes {
-		path := stripPrefix(write.GetUpdate().Name)
-
-		doc, err := s.getDocumentByPath(path)
+	if len(req.GetTransaction()) > 0 {
+		// the transaction ends with the commit, whether or not it succeeds
+		tx, err := s.endTransaction(req.GetTransaction())
 		if err != nil {
-			if errors.Is(err, ErrDocumentNotFound) || errors.Is(err, ErrCollectionNotFound) {
-				// Collections are created on the fly so can be missing
-				// if updating a document, then return error if document doesn't exist
-				if write.GetCurrentDocument().GetExists() {
-					return nil, err
-				}
-				doc = &Document{
-					name:           path,
-					subcollections: map[string]Collection{},
-					fields:         map[string]interface{}{},
-				}
-
-				doc, err = s.newDocumentWithPath(path)
-				if err != nil {
-					return nil, err
-				}
-			} else {
+			return nil, err
+		}
+		if tx.readOnly && len(writes) > 0 {
+			return nil, ErrReadOnlyTransaction
+		}
+		// read-only transactions are never aborted
+		if !tx.readOnly {
+			err = s.checkConflicts(tx)
+			if err != nil {
 				return nil, err
 			}
 		}
+	}
 
-		updateMask := write.GetUpdateMask().GetFieldPaths()
-		updateFields := write.GetUpdate().GetFields()
-		if len(updateMask) == 0 {
-			// no updateMask, clear all fields and set new ones
-			doc.Clear()
-			for field, value := range updateFields {
-				doc.SetWithValue(field, value)
-			}
-		} else {
-			for _, field := range updateMask {
-				doc.SetWithValue(field, updateFields[field])
-			}
+	s.version++
+	commitTime := time.Now()
+
+	responses := []*pb.WriteResult{}
+
+	// every write is staged before any is applied, so a failed write leaves
+	// the data unchanged
+	batch := s.newWriteBatch(commitTime)
+	for _, write := range writes {
+		response, err := batch.add(write)
+		if err != nil {
+			return nil, err
 		}
-		responses = append(responses, &pb.WriteResult{
-			UpdateTime: timestamppb.Now(),
-		})
+		responses = append(responses, response)
 	}
+	batch.apply()
+	s.notifyListeners()
 
 	return &pb.CommitResponse{
 		WriteResults: responses,
+		CommitTime:   timestamppb.New(commitTime),
+	}, nil
+}
+
+// BatchWrite overrides the FirestoreServer BatchWrite method
+func (s *MockServer) BatchWrite(ctx context.Context, req *pb.BatchWriteRequest) (*pb.BatchWriteResponse, error) {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+
+	writes := req.GetWrites()
+
+	// the writes can be applied in any order, so each document can only be
+	// written once
+	paths := map[string]bool{}
+	for _, write := range writes {
+		path := write.GetDelete()
+		if write.GetUpdate() != nil {
+			path = write.GetUpdate().GetName()
+		}
+		if paths[path] {
+			return nil, status.Errorf(codes.InvalidArgument, "batch write cannot write to the same document more than once: %s", path)
+		}
+		paths[path] = true
+	}
+
+	s.version++
+	commitTime := time.Now()
+
+	responses := []*pb.WriteResult{}
+	statuses := []*rpcstatus.Status{}
+
+	// each write is applied on its own, so a failed write doesn't affect the
+	// others
+	for _, write := range writes {
+		batch := s.newWriteBatch(commitTime)
+		response, err := batch.add(write)
+		if err != nil {
+			responses = append(responses, &pb.WriteResult{})
+			statuses = append(statuses, status.Convert(err).Proto())
+			continue
+		}
+		batch.apply()
+		responses = append(responses, response)
+		statuses = append(statuses, status.New(codes.OK, "").Proto())
+	}
+	s.notifyListeners()
+
+	return &pb.BatchWriteResponse{
+		WriteResults: responses,
+		Status:       statuses,
 	}, nil
 }
 
@@ -243,46 +380,199 @@ func (s *MockServer) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.Com
 func (s *MockServer) BatchGetDocuments(req *pb.BatchGetDocumentsRequest, bs pb.Firestore_BatchGetDocumentsServer) error {
 	s.dataLock.RLock()
 	defer s.dataLock.RUnlock()
-	for _, docId := range req.Documents {
-		path := stripPrefix(docId)
-		document, err := s.getDocumentByPath(path)
+
+	var tx *transaction
+	// newTransaction is the ID of the transaction started by the request,
+	// which is returned in the first response
+	var newTransaction []byte
+	if len(req.GetTransaction()) > 0 {
+		var err error
+		tx, err = s.getTransaction(req.GetTransaction())
 		if err != nil {
-			readTime := timestamppb.Now()
-			response := &pb.BatchGetDocumentsResponse{
-				Result:   &pb.BatchGetDocumentsResponse_Missing{Missing: docId},
-				ReadTime: readTime,
-			}
-			err = bs.Send(response)
+			return err
+		}
+	} else if options := req.GetNewTransaction(); options != nil {
+		tx = s.newTransaction(options.GetReadOnly() != nil)
+		newTransaction = tx.id
+	}
+
+	// every document is read at the same time. There is no history, so reads
+	// at an earlier time fail if a document has changed since.
+	readTime := timestamppb.Now()
+	if req.GetReadTime() != nil {
+		readTime = req.GetReadTime()
+		for _, docId := range req.Documents {
+			err := s.checkReadTime(stripPrefix(docId), readTime.AsTime())
 			if err != nil {
 				return err
 			}
-			return nil
 		}
-		readTime := timestamppb.Now()
+	}
+
+	var fields []*pb.StructuredQuery_FieldReference
+	if req.GetMask() != nil {
+		fields = maskFields(req.GetMask())
+	}
+
+	for _, docId := range req.Documents {
+		path := stripPrefix(docId)
+		if tx != nil {
+			s.recordRead(tx, path)
+		}
 		response := &pb.BatchGetDocumentsResponse{
-			Result: &pb.BatchGetDocumentsResponse_Found{
+			Transaction: newTransaction,
+			ReadTime:    readTime,
+		}
+		newTransaction = nil
+
+		document, err := s.getDocumentByPath(path)
+		if err != nil {
+			if !errors.Is(err, ErrDocumentNotFound) && !errors.Is(err, ErrCollectionNotFound) {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+			response.Result = &pb.BatchGetDocumentsResponse_Missing{Missing: docId}
+		} else {
+			if fields != nil {
+				document = projectDocument(document, fields)
+			}
+			response.Result = &pb.BatchGetDocumentsResponse_Found{
 				Found: document.ToProto(docId),
-			},
-			ReadTime: readTime,
+			}
 		}
 		err = bs.Send(response)
 		if err != nil {
 			return err
 		}
 	}
+
+	// the transaction is still returned when there are no documents
+	if newTransaction != nil {
+		return bs.Send(&pb.BatchGetDocumentsResponse{
+			Transaction: newTransaction,
+			ReadTime:    readTime,
+		})
+	}
 	return nil
 }
 
+// Firestore's value type ordering. Integers and doubles are both numbers.
+// https://firebase.google.com/docs/firestore/manage-data/data-types#value_type_ordering
+const (
+	nullTypeOrder = iota
+	booleanTypeOrder
+	numberTypeOrder
+	timestampTypeOrder
+	stringTypeOrder
+	bytesTypeOrder
+	referenceTypeOrder
+	geoPointTypeOrder
+	arrayTypeOrder
+	vectorTypeOrder
+	mapTypeOrder
+	unknownTypeOrder
+)
+
+func typeOrder(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return nullTypeOrder
+	case bool:
+		return booleanTypeOrder
+	case int64, float64:
+		return numberTypeOrder
+	case time.Time:
+		return timestampTypeOrder
+	case string:
+		return stringTypeOrder
+	case []byte:
+		return bytesTypeOrder
+	case Reference:
+		return referenceTypeOrder
+	case *latlng.LatLng:
+		return geoPointTypeOrder
+	case []interface{}:
+		return arrayTypeOrder
+	case Vector:
+		return vectorTypeOrder
+	case map[string]interface{}:
+		return mapTypeOrder
+	}
+	return unknownTypeOrder
+}
+
+// compareNumbers compares integers and doubles numerically, without losing
+// precision for large integers. NaN is before every other number.
+func compareNumbers(a, b interface{}) int {
+	if isNaN(a) || isNaN(b) {
+		if isNaN(a) && isNaN(b) {
+			return 0
+		} else if isNaN(a) {
+			return -1
+		}
+		return 1
+	}
+
+	ai, aok := a.(int64)
+	bi, bok := b.(int64)
+	switch {
+	case aok && bok:
+		if ai < bi {
+			return -1
+		} else if ai > bi {
+			return 1
+		}
+		return 0
+	case aok:
+		return compareIntegerToDouble(ai, numberAsFloat64(b))
+	case bok:
+		return -compareIntegerToDouble(bi, numberAsFloat64(a))
+	}
+
+	af, bf := numberAsFloat64(a), numberAsFloat64(b)
+	if af < bf {
+		return -1
+	} else if af > bf {
+		return 1
+	}
+	return 0
+}
+
+func compareIntegerToDouble(i int64, f float64) int {
+	// doubles outside of the int64 range, including infinities
+	if f >= math.MaxInt64 {
+		return -1
+	} else if f < math.MinInt64 {
+		return 1
+	}
+
+	whole := math.Trunc(f)
+	if i < int64(whole) {
+		return -1
+	} else if i > int64(whole) {
+		return 1
+	}
+	// the whole parts are equal, so the fraction decides
+	if f > whole {
+		return -1
+	} else if f < whole {
+		return 1
+	}
+	return 0
+}
+
+// lessThanVal orders values the way Firestore does. Values of different types
+// are ordered by type.
 func lessThanVal(aval, bval interface{}) bool {
-	// TODO support other existing types? And "value type ordering"?
-	// https://firebase.google.com/docs/firestore/manage-data/data-types
+	aOrder, bOrder := typeOrder(aval), typeOrder(bval)
+	if aOrder != bOrder {
+		return aOrder < bOrder
+	}
+
 	switch aval.(type) {
+	case int64, float64:
+		return compareNumbers(aval, bval) < 0
 	case string:
 		return aval.(string) < bval.(string)
-	case int:
-		return aval.(int) < bval.(int)
-	case float64:
-		return aval.(float64) < bval.(float64)
 	case bool:
 		// false < true
 		return !aval.(bool) && bval.(bool)
@@ -290,6 +580,18 @@ func lessThanVal(aval, bval interface{}) bool {
 		return aval.(time.Time).Before(bval.(time.Time))
 	case []byte:
 		return string(aval.([]byte)) < string(bval.([]byte))
+	case Reference:
+		return compareNames(string(aval.(Reference)), string(bval.(Reference))) < 0
+	case *latlng.LatLng:
+		// ordered by latitude, then longitude
+		aPoint := aval.(*latlng.LatLng)
+		bPoint := bval.(*latlng.LatLng)
+		if aPoint.GetLatitude() != bPoint.GetLatitude() {
+			return aPoint.GetLatitude() < bPoint.GetLatitude()
+		}
+		return aPoint.GetLongitude() < bPoint.GetLongitude()
+	case Vector:
+		return lessThanVector(aval.(Vector), bval.(Vector))
 	case map[string]interface{}:
 		aMap := aval.(map[string]interface{})
 		bMap := bval.(map[string]interface{})
@@ -338,16 +640,30 @@ func lessThanVal(aval, bval interface{}) bool {
 		blen := len(bArr)
 		len := min(alen, blen)
 		for i := 0; i < len; i++ {
-			if lessThanVal(aArr[0], bArr[0]) {
+			if lessThanVal(aArr[i], bArr[i]) {
 				return true
-			} else if lessThanVal(bArr[0], aArr[0]) {
+			} else if lessThanVal(bArr[i], aArr[i]) {
 				return false
 			}
 		}
+		// a is shorter than b
+		return alen < blen
 	}
 	return false
 }
 
+// compareValues returns -1 if a is less than b, 1 if a is greater than b and
+// 0 if they are equal.
+func compareValues(a, b interface{}) int {
+	if lessThanVal(a, b) {
+		return -1
+	}
+	if lessThanVal(b, a) {
+		return 1
+	}
+	return 0
+}
+
 func lessThan(a Document, b Document, field string, direction pb.StructuredQuery_Direction) bool {
 	aval := a.Get(field)
 	bval := b.Get(field)
@@ -365,90 +681,33 @@ func (s *MockServer) RunQuery(req *pb.RunQueryRequest, qs pb.Firestore_RunQueryS
 	s.dataLock.RLock()
 	defer s.dataLock.RUnlock()
 
-	squery := req.GetStructuredQuery()
-
-	path := req.Parent + "/" + squery.GetFrom()[0].GetCollectionId()
-	// get collection
-	collection, err := s.getCollectionByPath(path)
-	if err != nil {
-		if errors.Is(err, ErrCollectionNotFound) || errors.Is(err, ErrDocumentNotFound) {
-			collection = &Collection{
-				documents: map[string]*Document{},
-			}
-		} else {
+	var tx *transaction
+	if len(req.GetTransaction()) > 0 {
+		var err error
+		tx, err = s.getTransaction(req.GetTransaction())
+		if err != nil {
 			return err
 		}
 	}
 
-	// filter documents in collection
-	filteredDocs := []*Document{}
-
-	where := squery.GetWhere()
-	for _, doc := range collection.documents {
-		if matchFilter(*doc, where) {
-			filteredDocs = append(filteredDocs, doc)
-		}
-	}
-
-	// sort documents - if unspecified, sort by name
-	orderBys := squery.GetOrderBy()
-	sort.Slice(filteredDocs, func(i, j int) bool {
-		for _, orderBy := range orderBys {
-			field := orderBy.GetField().GetFieldPath()
-			if field == "__name__" || field == "DocumentID" {
-				if orderBy.GetDirection() == pb.StructuredQuery_ASCENDING {
-					if filteredDocs[i].name < filteredDocs[j].name {
-						return true
-					} else if filteredDocs[i].name > filteredDocs[j].name {
-						return false
-					}
-				} else {
-					if filteredDocs[i].name > filteredDocs[j].name {
-						return true
-					} else if filteredDocs[i].name < filteredDocs[j].name {
-						return false
-					}
-				}
-			} else {
-				if lessThan(*filteredDocs[i], *filteredDocs[j], field, orderBy.GetDirection()) {
-					return true
-				} else if lessThan(*filteredDocs[j], *filteredDocs[i], field, orderBy.GetDirection()) {
-					return false
-				}
-			}
-		}
-		return filteredDocs[i].name < filteredDocs[j].name
-	})
-
-	// limit and offset
-	limit := int(squery.GetLimit().GetValue())
-	offset := int(squery.GetOffset())
-
-	if limit == 0 {
-		limit = len(filteredDocs)
-	}
-
-	if offset+limit > len(filteredDocs) {
-		filteredDocs = filteredDocs[offset:]
-	} else {
-		filteredDocs = filteredDocs[offset : offset+limit]
+	filteredDocs, err := s.runQuery(req.GetParent(), req.GetStructuredQuery())
+	if err != nil {
+		return err
 	}
 
 	if len(filteredDocs) == 0 {
 		response := &pb.RunQueryResponse{
 			ReadTime: timestamppb.Now(),
 		}
-		err = qs.Send(response)
-		if err != nil {
-			return err
-		}
-		return nil
+		return qs.Send(response)
 	}
 	for _, doc := range filteredDocs {
+		if tx != nil {
+			s.recordRead(tx, doc.name)
+		}
 		response := &pb.RunQueryResponse{
 			// get the fullPath of the document
-			// does `projectID` really matter?
-			Document: doc.ToProto("projects/projectID/databases/(default)/documents/" + doc.name),
+			Document: doc.ToProto(documentsRoot(req.GetParent()) + "/" + doc.name),
 			ReadTime: timestamppb.Now(),
 		}
 		err = qs.Send(response)
@@ -459,23 +718,188 @@ func (s *MockServer) RunQuery(req *pb.RunQueryRequest, qs pb.Firestore_RunQueryS
 	return nil
 }
 
+// RunAggregationQuery overrides the FirestoreServer RunAggregationQuery method
+func (s *MockServer) RunAggregationQuery(req *pb.RunAggregationQueryRequest, qs pb.Firestore_RunAggregationQueryServer) error {
+	s.dataLock.RLock()
+	defer s.dataLock.RUnlock()
+
+	var tx *transaction
+	if len(req.GetTransaction()) > 0 {
+		var err error
+		tx, err = s.getTransaction(req.GetTransaction())
+		if err != nil {
+			return err
+		}
+	}
+
+	aquery := req.GetStructuredAggregationQuery()
+	docs, err := s.runQuery(req.GetParent(), aquery.GetStructuredQuery())
+	if err != nil {
+		return err
+	}
+	if tx != nil {
+		for _, doc := range docs {
+			s.recordRead(tx, doc.name)
+		}
+	}
+
+	fields := map[string]*pb.Value{}
+	for i, aggregation := range aquery.GetAggregations() {
+		value, err := aggregate(docs, aggregation)
+		if err != nil {
+			return err
+		}
+		fields[aggregationAlias(aggregation, i)] = value
+	}
+
+	return qs.Send(&pb.RunAggregationQueryResponse{
+		Result: &pb.AggregationResult{
+			AggregateFields: fields,
+		},
+		ReadTime: timestamppb.Now(),
+	})
+}
+
 // BeginTransaction overrides the FirestoreServer BeginTransaction method
 func (s *MockServer) BeginTransaction(ctx context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
-	// TODO
-	fmt.Println("BeginTransaction")
-	return nil, nil
+	// a retried transaction replaces the one it retries
+	if retry := req.GetOptions().GetReadWrite().GetRetryTransaction(); len(retry) > 0 {
+		s.endTransaction(retry)
+	}
+
+	tx := s.newTransaction(req.GetOptions().GetReadOnly() != nil)
+
+	return &pb.BeginTransactionResponse{
+		Transaction: tx.id,
+	}, nil
 }
 
 // Rollback overrides the FirestoreServer Rollback method
 func (s *MockServer) Rollback(ctx context.Context, req *pb.RollbackRequest) (*empty.Empty, error) {
-	// TODO
-	fmt.Println("Rollback")
-	return nil, nil
+	// writes are buffered by the client until Commit, so there is nothing
+	// to undo beyond discarding the transaction
+	_, err := s.endTransaction(req.GetTransaction())
+	if err != nil {
+		return nil, err
+	}
+
+	return &empty.Empty{}, nil
 }
 
 // Listen overrides the FirestoreServer Listen method
 func (s *MockServer) Listen(stream pb.Firestore_ListenServer) error {
-	// TODO
-	fmt.Print("Listen")
-	return nil
+	l := s.addListener(stream)
+	defer s.removeListener(l)
+
+	return l.run()
+}
+
+// ListDocuments overrides the FirestoreServer ListDocuments method
+func (s *MockServer) ListDocuments(ctx context.Context, req *pb.ListDocumentsRequest) (*pb.ListDocumentsResponse, error) {
+	s.dataLock.RLock()
+	defer s.dataLock.RUnlock()
+
+	var tx *transaction
+	if len(req.GetTransaction()) > 0 {
+		var err error
+		tx, err = s.getTransaction(req.GetTransaction())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	docs, err := s.listDocuments(req.GetParent(), req.GetCollectionId(), req.GetOrderBy(), req.GetShowMissing())
+	if err != nil {
+		return nil, err
+	}
+	start, end, nextPageToken, err := page(len(docs), req.GetPageSize(), req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []*pb.StructuredQuery_FieldReference
+	if req.GetMask() != nil {
+		fields = maskFields(req.GetMask())
+	}
+
+	documents := []*pb.Document{}
+	for _, doc := range docs[start:end] {
+		name := documentsRoot(req.GetParent()) + "/" + doc.name
+		if !doc.exists {
+			// missing documents only have a name
+			documents = append(documents, &pb.Document{Name: name})
+			continue
+		}
+		if tx != nil {
+			s.recordRead(tx, doc.name)
+		}
+		if fields != nil {
+			doc = projectDocument(doc, fields)
+		}
+		documents = append(documents, doc.ToProto(name))
+	}
+
+	return &pb.ListDocumentsResponse{
+		Documents:     documents,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// ListCollectionIds overrides the FirestoreServer ListCollectionIds method
+func (s *MockServer) ListCollectionIds(ctx context.Context, req *pb.ListCollectionIdsRequest) (*pb.ListCollectionIdsResponse, error) {
+	s.dataLock.RLock()
+	defer s.dataLock.RUnlock()
+
+	collectionIds, err := s.listCollectionIds(req.GetParent())
+	if err != nil {
+		return nil, err
+	}
+	start, end, nextPageToken, err := page(len(collectionIds), req.GetPageSize(), req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ListCollectionIdsResponse{
+		CollectionIds: collectionIds[start:end],
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// PartitionQuery overrides the FirestoreServer PartitionQuery method
+func (s *MockServer) PartitionQuery(ctx context.Context, req *pb.PartitionQueryRequest) (*pb.PartitionQueryResponse, error) {
+	s.dataLock.RLock()
+	defer s.dataLock.RUnlock()
+
+	if req.GetPartitionCount() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "partition count must be positive")
+	}
+	squery := req.GetStructuredQuery()
+	err := validatePartitionQuery(squery)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := s.runQuery(req.GetParent(), squery)
+	if err != nil {
+		return nil, err
+	}
+	names := partitionCursors(docs, req.GetPartitionCount())
+	start, end, nextPageToken, err := page(len(names), req.GetPageSize(), req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := []*pb.Cursor{}
+	for _, name := range names[start:end] {
+		partitions = append(partitions, &pb.Cursor{
+			Values: []*pb.Value{{
+				ValueType: &pb.Value_ReferenceValue{ReferenceValue: documentsRoot(req.GetParent()) + "/" + name},
+			}},
+		})
+	}
+
+	return &pb.PartitionQueryResponse{
+		Partitions:    partitions,
+		NextPageToken: nextPageToken,
+	}, nil
 }
@@ -0,0 +1,201 @@
+package firestarter
+
+import (
+	"encoding/json"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	collectionQueryScope      = "COLLECTION"
+	collectionGroupQueryScope = "COLLECTION_GROUP"
+	arrayContainsConfig       = "CONTAINS"
+)
+
+// indexDefinitions is the format of a firestore.indexes.json file. Field
+// overrides are ignored, so every single field index is assumed to exist.
+type indexDefinitions struct {
+	Indexes []index `json:"indexes"`
+}
+
+// index is a composite index.
+type index struct {
+	CollectionGroup string       `json:"collectionGroup"`
+	QueryScope      string       `json:"queryScope,omitempty"`
+	Fields          []indexField `json:"fields"`
+	// equalities is the number of fields of a required index that are for
+	// equality and array filters
+	equalities int
+}
+
+type indexField struct {
+	FieldPath    string        `json:"fieldPath"`
+	Order        string        `json:"order,omitempty"`
+	ArrayConfig  string        `json:"arrayConfig,omitempty"`
+	VectorConfig *vectorConfig `json:"vectorConfig,omitempty"`
+}
+
+type vectorConfig struct {
+	Dimension int       `json:"dimension"`
+	Flat      *struct{} `json:"flat,omitempty"`
+}
+
+// checkIndexes returns a FailedPrecondition error if the query needs a
+// composite index that isn't defined. Must be called with dataLock held.
+func (s *MockServer) checkIndexes(from *pb.StructuredQuery_CollectionSelector, squery *pb.StructuredQuery) error {
+	if s.indexes == nil {
+		// index enforcement is off
+		return nil
+	}
+
+	scope := collectionQueryScope
+	if from.GetAllDescendants() {
+		scope = collectionGroupQueryScope
+	}
+
+	// each disjunction is run separately, so each needs an index
+	for _, conjunction := range conjunctions(squery.GetWhere()) {
+		required, ok := requiredIndex(conjunction, squery)
+		if !ok {
+			continue
+		}
+		required.CollectionGroup = from.GetCollectionId()
+		required.QueryScope = scope
+
+		found := false
+		for _, index := range s.indexes {
+			if index.serves(required) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			definition, _ := json.Marshal(required)
+			return status.Errorf(codes.FailedPrecondition, "The query requires an index. Add it to the index definition file: %s", definition)
+		}
+	}
+	return nil
+}
+
+// requiredIndex returns the composite index needed to run the conjunction of
+// the query, or false if single field indexes are enough. Equality and array
+// fields are first, followed by the ordered fields.
+func requiredIndex(conjunction []*pb.StructuredQuery_Filter, squery *pb.StructuredQuery) (index, bool) {
+	required := index{}
+	equalities := map[string]bool{}
+	addEquality := func(field indexField) {
+		if !isNameField(field.FieldPath) && !equalities[field.FieldPath] {
+			equalities[field.FieldPath] = true
+			required.Fields = append(required.Fields, field)
+		}
+	}
+
+	for _, filter := range conjunction {
+		switch f := filter.GetFilterType().(type) {
+		case *pb.StructuredQuery_Filter_FieldFilter:
+			field := f.FieldFilter.GetField().GetFieldPath()
+			switch f.FieldFilter.GetOp() {
+			case pb.StructuredQuery_FieldFilter_EQUAL, pb.StructuredQuery_FieldFilter_IN:
+				addEquality(indexField{FieldPath: field, Order: pb.StructuredQuery_ASCENDING.String()})
+			case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS, pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS_ANY:
+				addEquality(indexField{FieldPath: field, ArrayConfig: arrayContainsConfig})
+			}
+		case *pb.StructuredQuery_Filter_UnaryFilter:
+			switch f.UnaryFilter.GetOp() {
+			case pb.StructuredQuery_UnaryFilter_IS_NULL, pb.StructuredQuery_UnaryFilter_IS_NAN:
+				addEquality(indexField{FieldPath: f.UnaryFilter.GetField().GetFieldPath(), Order: pb.StructuredQuery_ASCENDING.String()})
+			}
+		}
+	}
+
+	required.equalities = len(required.Fields)
+
+	if findNearest := squery.GetFindNearest(); findNearest != nil {
+		// there are no single field vector indexes
+		required.Fields = append(required.Fields, indexField{
+			FieldPath: findNearest.GetVectorField().GetFieldPath(),
+			VectorConfig: &vectorConfig{
+				Dimension: len(findNearest.GetQueryVector().GetMapValue().GetFields()[vectorValueKey].GetArrayValue().GetValues()),
+				Flat:      &struct{}{},
+			},
+		})
+		return required, true
+	}
+
+	// without an explicit order, the query is ordered by its inequality fields
+	orderBys := queryOrderBys(squery)
+	orderings := 0
+	for _, orderBy := range orderBys {
+		field := orderBy.GetField().GetFieldPath()
+		if isNameField(field) || equalities[field] {
+			continue
+		}
+		orderings++
+		required.Fields = append(required.Fields, indexField{FieldPath: field, Order: orderBy.GetDirection().String()})
+	}
+
+	// equalities are served by merging single field indexes, and a single
+	// ordering by the single field index of the field
+	if orderings == 0 || len(required.Fields) == 1 {
+		return required, false
+	}
+	return required, true
+}
+
+// serves returns whether the index can be used to run a query needing the
+// required index. The equality fields can be in any order, and the ordered
+// fields must all be in the same or all in the opposite direction.
+func (i index) serves(required index) bool {
+	if i.CollectionGroup != required.CollectionGroup {
+		return false
+	}
+	if i.QueryScope != required.QueryScope && !(i.QueryScope == "" && required.QueryScope == collectionQueryScope) {
+		return false
+	}
+
+	fields := i.Fields
+	if len(fields) > 0 && isNameField(fields[len(fields)-1].FieldPath) {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) != len(required.Fields) {
+		return false
+	}
+
+	equalities := map[string]indexField{}
+	for _, field := range required.Fields[:required.equalities] {
+		equalities[field.FieldPath] = field
+	}
+
+	reversed := false
+	for j, field := range fields {
+		if j < required.equalities {
+			want, ok := equalities[field.FieldPath]
+			if !ok || want.ArrayConfig != field.ArrayConfig || field.VectorConfig != nil {
+				return false
+			}
+			continue
+		}
+
+		want := required.Fields[j]
+		if field.FieldPath != want.FieldPath || field.ArrayConfig != "" {
+			return false
+		}
+		if want.VectorConfig != nil {
+			if field.VectorConfig == nil || field.VectorConfig.Dimension != want.VectorConfig.Dimension {
+				return false
+			}
+			continue
+		}
+		if field.VectorConfig != nil {
+			return false
+		}
+		if j == required.equalities {
+			reversed = field.Order != want.Order
+		} else if (field.Order != want.Order) != reversed {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package firestarter
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrInvalidPageToken = status.Error(codes.InvalidArgument, "page token is invalid")
+
+// listDocuments returns the documents of the collection under parent, or of
+// every collection under parent if collectionId is empty, in the order of
+// orderBy. Documents that don't exist but have subcollections are included if
+// showMissing is set. Must be called with dataLock held.
+func (s *MockServer) listDocuments(parent string, collectionId string, orderBy string, showMissing bool) ([]*Document, error) {
+	if showMissing && orderBy != "" {
+		return nil, status.Error(codes.InvalidArgument, "order by cannot be used with show missing")
+	}
+	orderBys, err := parseListOrderBy(orderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	// start at the root, or the parent document
+	document := &Document{
+		subcollections: s.data,
+	}
+	if path := stripPrefix(parent); path != "" {
+		document, err = s.lookupDocument(path)
+		if err != nil {
+			if errors.Is(err, ErrCollectionNotFound) || errors.Is(err, ErrDocumentNotFound) {
+				return []*Document{}, nil
+			}
+			return nil, err
+		}
+	}
+
+	docs := []*Document{}
+	for id, collection := range document.subcollections {
+		if collectionId != "" && id != collectionId {
+			continue
+		}
+		for _, doc := range collection.documents {
+			if doc.exists || showMissing {
+				docs = append(docs, doc)
+			}
+		}
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		for _, orderBy := range orderBys {
+			field := orderBy.GetField().GetFieldPath()
+			if isNameField(field) {
+				break
+			}
+			c := compareValues(docs[i].Get(field), docs[j].Get(field))
+			if orderBy.GetDirection() == pb.StructuredQuery_DESCENDING {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		// documents are ordered by name last, in the direction of the last
+		// ordering
+		if len(orderBys) > 0 && orderBys[len(orderBys)-1].GetDirection() == pb.StructuredQuery_DESCENDING {
+			return compareNames(docs[i].name, docs[j].name) > 0
+		}
+		return compareNames(docs[i].name, docs[j].name) < 0
+	})
+	return docs, nil
+}
+
+// parseListOrderBy parses a ListDocuments ordering such as
+// "priority desc, __name__ desc".
+func parseListOrderBy(orderBy string) ([]*pb.StructuredQuery_Order, error) {
+	orderBys := []*pb.StructuredQuery_Order{}
+	if strings.TrimSpace(orderBy) == "" {
+		return orderBys, nil
+	}
+	for _, part := range strings.Split(orderBy, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid order by: %q", orderBy)
+		}
+		direction := pb.StructuredQuery_ASCENDING
+		if len(fields) == 2 {
+			switch strings.ToLower(fields[1]) {
+			case "asc":
+			case "desc":
+				direction = pb.StructuredQuery_DESCENDING
+			default:
+				return nil, status.Errorf(codes.InvalidArgument, "invalid order by: %q", orderBy)
+			}
+		}
+		orderBys = append(orderBys, &pb.StructuredQuery_Order{
+			Field:     &pb.StructuredQuery_FieldReference{FieldPath: fields[0]},
+			Direction: direction,
+		})
+	}
+	return orderBys, nil
+}
+
+// page returns the page of n items starting at the page token, and the token
+// of the next page, which is empty on the last page. A page size of 0 returns
+// every remaining item.
+func page(n int, pageSize int32, pageToken string) (int, int, string, error) {
+	start := 0
+	if pageToken != "" {
+		var err error
+		start, err = strconv.Atoi(pageToken)
+		if err != nil || start < 0 || start > n {
+			return 0, 0, "", ErrInvalidPageToken
+		}
+	}
+	if pageSize < 0 {
+		return 0, 0, "", status.Error(codes.InvalidArgument, "page size must be non-negative")
+	}
+
+	end := n
+	if pageSize > 0 && start+int(pageSize) < n {
+		end = start + int(pageSize)
+	}
+	nextPageToken := ""
+	if end < n {
+		nextPageToken = strconv.Itoa(end)
+	}
+	return start, end, nextPageToken, nil
+}
+
+// listCollectionIds returns the sorted IDs of the collections under parent,
+// which is either the documents root or a document. Must be called with
+// dataLock held.
+func (s *MockServer) listCollectionIds(parent string) ([]string, error) {
+	document := &Document{
+		subcollections: s.data,
+	}
+	if path := stripPrefix(parent); path != "" {
+		var err error
+		document, err = s.lookupDocument(path)
+		if err != nil {
+			if errors.Is(err, ErrCollectionNotFound) || errors.Is(err, ErrDocumentNotFound) {
+				return []string{}, nil
+			}
+			return nil, err
+		}
+	}
+
+	collectionIds := []string{}
+	for id, collection := range document.subcollections {
+		if len(collection.documents) > 0 {
+			collectionIds = append(collectionIds, id)
+		}
+	}
+	sort.Strings(collectionIds)
+	return collectionIds, nil
+}
@@ -0,0 +1,329 @@
+package firestarter
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"time"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// listener holds the state of a Listen stream.
+type listener struct {
+	s      *MockServer
+	stream pb.Firestore_ListenServer
+	// notify is signalled whenever the data changes
+	notify  chan struct{}
+	targets map[int32]*listenTarget
+}
+
+// listenTarget holds the state of a target added to a Listen stream.
+type listenTarget struct {
+	target *pb.Target
+	// update times of the documents last sent for the target, keyed by name
+	documents map[string]time.Time
+}
+
+func (s *MockServer) addListener(stream pb.Firestore_ListenServer) *listener {
+	l := &listener{
+		s:       s,
+		stream:  stream,
+		notify:  make(chan struct{}, 1),
+		targets: map[int32]*listenTarget{},
+	}
+
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	s.listeners[l] = true
+	return l
+}
+
+func (s *MockServer) removeListener(l *listener) {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	delete(s.listeners, l)
+}
+
+// notifyListeners signals every listener that the data has changed.
+func (s *MockServer) notifyListeners() {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	for l := range s.listeners {
+		select {
+		case l.notify <- struct{}{}:
+		default:
+			// the listener already has a pending notification
+		}
+	}
+}
+
+// resumeToken identifies the version of the data a listener is current with.
+// Must be called with dataLock held.
+func (s *MockServer) resumeToken() []byte {
+	return []byte(strconv.FormatInt(s.version, 10))
+}
+
+// run handles requests and sends changes until the stream is closed.
+func (l *listener) run() error {
+	ctx := l.stream.Context()
+
+	requests := make(chan *pb.ListenRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := l.stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		var err error
+		select {
+		case req := <-requests:
+			err = l.handleRequest(req)
+		case <-l.notify:
+			err = l.update()
+		case err = <-errs:
+			if err == io.EOF {
+				return nil
+			}
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (l *listener) handleRequest(req *pb.ListenRequest) error {
+	switch change := req.GetTargetChange().(type) {
+	case *pb.ListenRequest_AddTarget:
+		return l.addTarget(change.AddTarget)
+	case *pb.ListenRequest_RemoveTarget:
+		return l.removeTarget(change.RemoveTarget)
+	}
+	return status.Errorf(codes.InvalidArgument, "unsupported target change: %T", req.GetTargetChange())
+}
+
+func (l *listener) addTarget(target *pb.Target) error {
+	targetId := target.GetTargetId()
+	if targetId == 0 {
+		// the server assigns an ID when the client doesn't
+		targetId = 1
+		for l.targets[targetId] != nil {
+			targetId++
+		}
+	}
+	if l.targets[targetId] != nil {
+		return status.Errorf(codes.InvalidArgument, "target ID %d already exists", targetId)
+	}
+
+	t := &listenTarget{
+		target:    target,
+		documents: map[string]time.Time{},
+	}
+	responses := []*pb.ListenResponse{
+		targetChange(pb.TargetChange_ADD, targetId, nil),
+	}
+
+	l.s.dataLock.RLock()
+	docs, err := l.s.targetDocuments(target)
+	if err != nil {
+		l.s.dataLock.RUnlock()
+		response := targetChange(pb.TargetChange_REMOVE, targetId, nil)
+		response.GetTargetChange().Cause = status.Convert(err).Proto()
+		return l.send(append(responses, response))
+	}
+	resumeToken := l.s.resumeToken()
+	readTime := timestamppb.Now()
+
+	if len(target.GetResumeToken()) > 0 && bytes.Equal(target.GetResumeToken(), resumeToken) {
+		// nothing has changed since the client was last current
+		t.changes(targetId, docs, l.s)
+	} else {
+		if len(target.GetResumeToken()) > 0 || target.GetReadTime() != nil {
+			// changes since an older version aren't kept, so the client
+			// must start over
+			responses = append(responses, targetChange(pb.TargetChange_RESET, targetId, nil))
+		}
+		responses = append(responses, t.changes(targetId, docs, l.s)...)
+	}
+	l.s.dataLock.RUnlock()
+
+	responses = append(responses, targetChange(pb.TargetChange_CURRENT, targetId, resumeToken))
+	if target.GetOnce() {
+		responses = append(responses, targetChange(pb.TargetChange_REMOVE, targetId, nil))
+	} else {
+		l.targets[targetId] = t
+	}
+	responses = append(responses, globalChange(resumeToken, readTime))
+
+	return l.send(responses)
+}
+
+func (l *listener) removeTarget(targetId int32) error {
+	if l.targets[targetId] == nil {
+		return status.Errorf(codes.InvalidArgument, "target ID %d does not exist", targetId)
+	}
+	delete(l.targets, targetId)
+
+	return l.send([]*pb.ListenResponse{
+		targetChange(pb.TargetChange_REMOVE, targetId, nil),
+	})
+}
+
+// update sends the changes to every target since they were last sent.
+func (l *listener) update() error {
+	responses := []*pb.ListenResponse{}
+
+	l.s.dataLock.RLock()
+	for targetId, t := range l.targets {
+		docs, err := l.s.targetDocuments(t.target)
+		if err != nil {
+			delete(l.targets, targetId)
+			response := targetChange(pb.TargetChange_REMOVE, targetId, nil)
+			response.GetTargetChange().Cause = status.Convert(err).Proto()
+			responses = append(responses, response)
+			continue
+		}
+		responses = append(responses, t.changes(targetId, docs, l.s)...)
+	}
+	resumeToken := l.s.resumeToken()
+	readTime := timestamppb.Now()
+	l.s.dataLock.RUnlock()
+
+	if len(responses) == 0 {
+		return nil
+	}
+	return l.send(append(responses, globalChange(resumeToken, readTime)))
+}
+
+func (l *listener) send(responses []*pb.ListenResponse) error {
+	for _, response := range responses {
+		err := l.stream.Send(response)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changes returns the responses that bring the documents last sent for the
+// target up to date with docs, and records docs as sent. Must be called with
+// dataLock held.
+func (t *listenTarget) changes(targetId int32, docs []*pb.Document, s *MockServer) []*pb.ListenResponse {
+	responses := []*pb.ListenResponse{}
+	documents := map[string]time.Time{}
+	for _, doc := range docs {
+		updateTime := doc.GetUpdateTime().AsTime()
+		documents[doc.GetName()] = updateTime
+		if sent, ok := t.documents[doc.GetName()]; ok && sent.Equal(updateTime) {
+			continue
+		}
+		responses = append(responses, &pb.ListenResponse{
+			ResponseType: &pb.ListenResponse_DocumentChange{
+				DocumentChange: &pb.DocumentChange{
+					Document:  doc,
+					TargetIds: []int32{targetId},
+				},
+			},
+		})
+	}
+
+	for name := range t.documents {
+		if _, ok := documents[name]; ok {
+			continue
+		}
+		if _, err := s.getDocumentByPath(stripPrefix(name)); err != nil {
+			responses = append(responses, &pb.ListenResponse{
+				ResponseType: &pb.ListenResponse_DocumentDelete{
+					DocumentDelete: &pb.DocumentDelete{
+						Document:         name,
+						RemovedTargetIds: []int32{targetId},
+						ReadTime:         timestamppb.Now(),
+					},
+				},
+			})
+		} else {
+			// the document exists but no longer matches the target
+			responses = append(responses, &pb.ListenResponse{
+				ResponseType: &pb.ListenResponse_DocumentRemove{
+					DocumentRemove: &pb.DocumentRemove{
+						Document:         name,
+						RemovedTargetIds: []int32{targetId},
+						ReadTime:         timestamppb.Now(),
+					},
+				},
+			})
+		}
+	}
+
+	t.documents = documents
+	return responses
+}
+
+// targetDocuments returns the documents currently matching the target. Must be
+// called with dataLock held.
+func (s *MockServer) targetDocuments(target *pb.Target) ([]*pb.Document, error) {
+	docs := []*pb.Document{}
+	switch t := target.GetTargetType().(type) {
+	case *pb.Target_Documents:
+		for _, name := range t.Documents.GetDocuments() {
+			doc, err := s.getDocumentByPath(stripPrefix(name))
+			if err != nil {
+				continue
+			}
+			docs = append(docs, doc.ToProto(name))
+		}
+	case *pb.Target_Query:
+		parent := t.Query.GetParent()
+		results, err := s.runQuery(parent, t.Query.GetStructuredQuery())
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range results {
+			docs = append(docs, doc.ToProto(documentsRoot(parent)+"/"+doc.name))
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported target type: %T", t)
+	}
+	return docs, nil
+}
+
+func targetChange(changeType pb.TargetChange_TargetChangeType, targetId int32, resumeToken []byte) *pb.ListenResponse {
+	return &pb.ListenResponse{
+		ResponseType: &pb.ListenResponse_TargetChange{
+			TargetChange: &pb.TargetChange{
+				TargetChangeType: changeType,
+				TargetIds:        []int32{targetId},
+				ResumeToken:      resumeToken,
+			},
+		},
+	}
+}
+
+// globalChange marks a consistent snapshot across every target of the stream.
+func globalChange(resumeToken []byte, readTime *timestamppb.Timestamp) *pb.ListenResponse {
+	return &pb.ListenResponse{
+		ResponseType: &pb.ListenResponse_TargetChange{
+			TargetChange: &pb.TargetChange{
+				TargetChangeType: pb.TargetChange_NO_CHANGE,
+				ResumeToken:      resumeToken,
+				ReadTime:         readTime,
+			},
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package firestarter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	assert "github.com/stretchr/testify/assert"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestListenResumeToken(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, srv, err := New()
+	assert.Nil(err)
+	defer srv.Close()
+
+	srv.LoadFromJSONFile("test.json")
+
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(err)
+	defer conn.Close()
+	client := pb.NewFirestoreClient(conn)
+
+	const database = "projects/projectID/databases/(default)"
+	const name = database + "/documents/collection-1/document-1-1"
+	listen := func(resumeToken []byte) []*pb.ListenResponse {
+		stream, err := client.Listen(ctx)
+		assert.Nil(err)
+		defer stream.CloseSend()
+
+		err = stream.Send(&pb.ListenRequest{
+			Database: database,
+			TargetChange: &pb.ListenRequest_AddTarget{
+				AddTarget: &pb.Target{
+					TargetType: &pb.Target_Documents{
+						Documents: &pb.Target_DocumentsTarget{Documents: []string{name}},
+					},
+					ResumeType: &pb.Target_ResumeToken{ResumeToken: resumeToken},
+					TargetId:   1,
+				},
+			},
+		})
+		assert.Nil(err)
+
+		// read until the global NO_CHANGE
+		responses := []*pb.ListenResponse{}
+		for {
+			response, err := stream.Recv()
+			assert.Nil(err)
+			responses = append(responses, response)
+			tc := response.GetTargetChange()
+			if tc != nil && tc.TargetChangeType == pb.TargetChange_NO_CHANGE && len(tc.TargetIds) == 0 {
+				return responses
+			}
+		}
+	}
+
+	// a new target gets every document
+	responses := listen(nil)
+	assert.Len(responses, 4)
+	assert.Equal(pb.TargetChange_ADD, responses[0].GetTargetChange().TargetChangeType)
+	assert.Equal(name, responses[1].GetDocumentChange().GetDocument().GetName())
+	assert.Equal(pb.TargetChange_CURRENT, responses[2].GetTargetChange().TargetChangeType)
+	resumeToken := responses[3].GetTargetChange().GetResumeToken()
+	assert.NotEmpty(resumeToken)
+
+	// resuming when nothing has changed sends no documents
+	responses = listen(resumeToken)
+	assert.Len(responses, 3)
+	assert.Equal(pb.TargetChange_ADD, responses[0].GetTargetChange().TargetChangeType)
+	assert.Equal(pb.TargetChange_CURRENT, responses[1].GetTargetChange().TargetChangeType)
+
+	// resuming after a change resets the target
+	_, err = client.Commit(ctx, &pb.CommitRequest{
+		Database: database,
+		Writes: []*pb.Write{{
+			Operation: &pb.Write_Delete{Delete: database + "/documents/collection-1/document-1-2"},
+		}},
+	})
+	assert.Nil(err)
+
+	responses = listen(resumeToken)
+	assert.Len(responses, 5)
+	assert.Equal(pb.TargetChange_ADD, responses[0].GetTargetChange().TargetChangeType)
+	assert.Equal(pb.TargetChange_RESET, responses[1].GetTargetChange().TargetChangeType)
+	assert.Equal(name, responses[2].GetDocumentChange().GetDocument().GetName())
+	assert.Equal(pb.TargetChange_CURRENT, responses[3].GetTargetChange().TargetChangeType)
+	assert.NotEqual(resumeToken, responses[4].GetTargetChange().GetResumeToken())
+}
@@ -0,0 +1,44 @@
+package firestarter
+
+import (
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// validatePartitionQuery returns an InvalidArgument error unless the query is
+// a collection group query ordered only by name ascending.
+func validatePartitionQuery(squery *pb.StructuredQuery) error {
+	if squery == nil {
+		return status.Error(codes.InvalidArgument, "partition query must have a structured query")
+	}
+	from := squery.GetFrom()
+	if len(from) != 1 || !from[0].GetAllDescendants() {
+		return status.Error(codes.InvalidArgument, "partition query must be a collection group query")
+	}
+	for _, orderBy := range squery.GetOrderBy() {
+		if !isNameField(orderBy.GetField().GetFieldPath()) || orderBy.GetDirection() == pb.StructuredQuery_DESCENDING {
+			return status.Error(codes.InvalidArgument, "partition query must be ordered by __name__ ascending")
+		}
+	}
+	if squery.GetWhere() != nil || squery.GetStartAt() != nil || squery.GetEndAt() != nil ||
+		squery.GetLimit() != nil || squery.GetOffset() != 0 || squery.GetFindNearest() != nil {
+		return status.Error(codes.InvalidArgument, "partition query cannot have filters, cursors, limits or offsets")
+	}
+	return nil
+}
+
+// partitionCursors splits the documents, in name order, into at most
+// partitionCount ranges of about the same size, returning the name of the
+// first document of every range but the first.
+func partitionCursors(docs []*Document, partitionCount int64) []string {
+	names := []string{}
+	for i := int64(1); i < partitionCount; i++ {
+		j := int(i * int64(len(docs)) / partitionCount)
+		if j == 0 || (len(names) > 0 && names[len(names)-1] == docs[j].name) {
+			continue
+		}
+		names = append(names, docs[j].name)
+	}
+	return names
+}
@@ -0,0 +1,300 @@
+package firestarter
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// runQuery returns the documents under parent matching the query, in query
+// order. Must be called with dataLock held.
+func (s *MockServer) runQuery(parent string, squery *pb.StructuredQuery) ([]*Document, error) {
+	from := squery.GetFrom()
+	if len(from) != 1 {
+		return nil, status.Error(codes.InvalidArgument, "query must have exactly one collection selector")
+	}
+	err := validateQuery(squery)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkIndexes(from[0], squery)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := s.collectionDocuments(parent, from[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// filter documents in collection
+	filteredDocs := []*Document{}
+
+	where := squery.GetWhere()
+	for _, doc := range docs {
+		if !doc.exists || !hasOrderByFields(doc, squery.GetOrderBy()) {
+			continue
+		}
+		if matchFilter(*doc, where) {
+			filteredDocs = append(filteredDocs, doc)
+		}
+	}
+
+	// vector search replaces ordering, cursors and limits
+	if findNearest := squery.GetFindNearest(); findNearest != nil {
+		filteredDocs, err = nearestDocuments(filteredDocs, findNearest)
+		if err != nil {
+			return nil, err
+		}
+		return projectDocuments(filteredDocs, squery.GetSelect()), nil
+	}
+
+	// sort documents - if unspecified, sort by name
+	orderBys := queryOrderBys(squery)
+	sort.Slice(filteredDocs, func(i, j int) bool {
+		for _, orderBy := range orderBys {
+			field := orderBy.GetField().GetFieldPath()
+			if isNameField(field) {
+				c := compareNames(filteredDocs[i].name, filteredDocs[j].name)
+				if orderBy.GetDirection() == pb.StructuredQuery_DESCENDING {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			} else {
+				if lessThan(*filteredDocs[i], *filteredDocs[j], field, orderBy.GetDirection()) {
+					return true
+				} else if lessThan(*filteredDocs[j], *filteredDocs[i], field, orderBy.GetDirection()) {
+					return false
+				}
+			}
+		}
+		return compareNames(filteredDocs[i].name, filteredDocs[j].name) < 0
+	})
+
+	// cursors
+	if startAt := squery.GetStartAt(); startAt != nil {
+		cursorDocs := []*Document{}
+		for _, doc := range filteredDocs {
+			c := compareToCursor(doc, orderBys, startAt.GetValues())
+			if c > 0 || (c == 0 && startAt.GetBefore()) {
+				cursorDocs = append(cursorDocs, doc)
+			}
+		}
+		filteredDocs = cursorDocs
+	}
+	if endAt := squery.GetEndAt(); endAt != nil {
+		cursorDocs := []*Document{}
+		for _, doc := range filteredDocs {
+			c := compareToCursor(doc, orderBys, endAt.GetValues())
+			if c < 0 || (c == 0 && !endAt.GetBefore()) {
+				cursorDocs = append(cursorDocs, doc)
+			}
+		}
+		filteredDocs = cursorDocs
+	}
+
+	// limit and offset
+	limit := int(squery.GetLimit().GetValue())
+	offset := int(squery.GetOffset())
+
+	if limit == 0 {
+		limit = len(filteredDocs)
+	}
+
+	if offset > len(filteredDocs) {
+		offset = len(filteredDocs)
+	}
+	if offset+limit > len(filteredDocs) {
+		filteredDocs = filteredDocs[offset:]
+	} else {
+		filteredDocs = filteredDocs[offset : offset+limit]
+	}
+
+	return projectDocuments(filteredDocs, squery.GetSelect()), nil
+}
+
+// projectDocuments returns the documents with only the fields selected by the
+// projection, or all fields if there is no projection.
+func projectDocuments(docs []*Document, projection *pb.StructuredQuery_Projection) []*Document {
+	if projection == nil {
+		return docs
+	}
+	projectedDocs := make([]*Document, len(docs))
+	for i, doc := range docs {
+		projectedDocs[i] = projectDocument(doc, projection.GetFields())
+	}
+	return projectedDocs
+}
+
+// projectDocument returns a copy of the document with only the fields selected
+// by the projection. Selecting only the document name returns no fields.
+func projectDocument(doc *Document, fields []*pb.StructuredQuery_FieldReference) *Document {
+	projected := doc.clone()
+	projected.Clear()
+	for _, field := range fields {
+		if isNameField(field.GetFieldPath()) {
+			continue
+		}
+		path := parseFieldPath(field.GetFieldPath())
+		if value, ok := doc.GetPath(path); ok {
+			projected.SetPath(path, copyValue(value))
+		}
+	}
+	return projected
+}
+
+// maskFields returns the field references of the paths in the document mask.
+func maskFields(mask *pb.DocumentMask) []*pb.StructuredQuery_FieldReference {
+	fields := []*pb.StructuredQuery_FieldReference{}
+	for _, path := range mask.GetFieldPaths() {
+		fields = append(fields, &pb.StructuredQuery_FieldReference{FieldPath: path})
+	}
+	return fields
+}
+
+// collectionDocuments returns the documents of the collections under parent
+// selected by from. A collection group selector matches every collection with
+// the ID at any depth under parent. Must be called with dataLock held.
+func (s *MockServer) collectionDocuments(parent string, from *pb.StructuredQuery_CollectionSelector) ([]*Document, error) {
+	if !from.GetAllDescendants() {
+		collection, err := s.getCollectionByPath(parent + "/" + from.GetCollectionId())
+		if err != nil {
+			if errors.Is(err, ErrCollectionNotFound) || errors.Is(err, ErrDocumentNotFound) {
+				return []*Document{}, nil
+			}
+			return nil, err
+		}
+		docs := []*Document{}
+		for _, doc := range collection.documents {
+			docs = append(docs, doc)
+		}
+		return docs, nil
+	}
+
+	// start at the root, or the parent document
+	document := &Document{
+		subcollections: s.data,
+	}
+	if path := stripPrefix(parent); path != "" {
+		var err error
+		document, err = s.lookupDocument(path)
+		if err != nil {
+			if errors.Is(err, ErrCollectionNotFound) || errors.Is(err, ErrDocumentNotFound) {
+				return []*Document{}, nil
+			}
+			return nil, err
+		}
+	}
+	return descendantDocuments(document, from.GetCollectionId(), []*Document{}), nil
+}
+
+// descendantDocuments appends the documents of every collection with the ID
+// under doc to docs. An empty ID matches every collection.
+func descendantDocuments(doc *Document, collectionId string, docs []*Document) []*Document {
+	for id, collection := range doc.subcollections {
+		for _, d := range collection.documents {
+			if collectionId == "" || id == collectionId {
+				docs = append(docs, d)
+			}
+			docs = descendantDocuments(d, collectionId, docs)
+		}
+	}
+	return docs
+}
+
+// hasOrderByFields returns whether the document has every field it is ordered
+// by. Documents without an order by field are excluded from the results.
+func hasOrderByFields(doc *Document, orderBys []*pb.StructuredQuery_Order) bool {
+	for _, orderBy := range orderBys {
+		field := orderBy.GetField().GetFieldPath()
+		if isNameField(field) {
+			continue
+		}
+		if _, ok := doc.GetPath(parseFieldPath(field)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// compareNames compares document names segment by segment, the way Firestore
+// orders documents and references.
+func compareNames(a, b string) int {
+	aParts := strings.Split(a, "/")
+	bParts := strings.Split(b, "/")
+	for i := 0; i < min(len(aParts), len(bParts)); i++ {
+		if c := strings.Compare(aParts[i], bParts[i]); c != 0 {
+			return c
+		}
+	}
+	return len(aParts) - len(bParts)
+}
+
+func isNameField(field string) bool {
+	return field == "__name__" || field == "DocumentID"
+}
+
+// queryOrderBys returns the orderings of the query, including the implicit
+// orderings. Inequality fields that aren't ordered explicitly are ordered
+// next, by field name, followed by the document name. Implicit orderings use
+// the direction of the last explicit ordering.
+func queryOrderBys(squery *pb.StructuredQuery) []*pb.StructuredQuery_Order {
+	orderBys := squery.GetOrderBy()
+	orderBys = orderBys[:len(orderBys):len(orderBys)]
+	ordered := map[string]bool{}
+	direction := pb.StructuredQuery_ASCENDING
+	for _, orderBy := range orderBys {
+		if isNameField(orderBy.GetField().GetFieldPath()) {
+			return orderBys
+		}
+		ordered[orderBy.GetField().GetFieldPath()] = true
+		direction = orderBy.GetDirection()
+	}
+
+	for _, field := range sortedFields(inequalityFields(squery.GetWhere(), map[string]bool{})) {
+		if !ordered[field] {
+			orderBys = append(orderBys, &pb.StructuredQuery_Order{
+				Field:     &pb.StructuredQuery_FieldReference{FieldPath: field},
+				Direction: direction,
+			})
+		}
+	}
+	return append(orderBys, &pb.StructuredQuery_Order{
+		Field:     &pb.StructuredQuery_FieldReference{FieldPath: "__name__"},
+		Direction: direction,
+	})
+}
+
+// compareToCursor compares the document to the cursor values in query order,
+// returning -1 if the document is before the cursor, 1 if it is after the
+// cursor and 0 if it is at the cursor.
+func compareToCursor(doc *Document, orderBys []*pb.StructuredQuery_Order, values []*pb.Value) int {
+	for i, value := range values {
+		if i >= len(orderBys) {
+			break
+		}
+		field := orderBys[i].GetField().GetFieldPath()
+
+		var c int
+		if isNameField(field) {
+			// document name cursor values are references
+			c = compareNames(doc.name, stripPrefix(value.GetReferenceValue()))
+		} else {
+			c = compareValues(doc.Get(field), protoValueToValue(value))
+		}
+
+		if orderBys[i].GetDirection() == pb.StructuredQuery_DESCENDING {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
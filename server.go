@@ -24,13 +24,14 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
 	gsrv "github.com/weathersource/go-gsrv"
-	pb "google.golang.org/genproto/googleapis/firestore/v1"
 )
 
 // MockServer mocks the pb.FirestoreServer interface
-// (https://godoc.org/google.golang.org/genproto/googleapis/firestore/v1beta1#FirestoreServer)
+// (https://pkg.go.dev/cloud.google.com/go/firestore/apiv1/firestorepb#FirestoreServer)
 type MockServer struct {
 	pb.FirestoreServer
 	Addr string
@@ -38,6 +39,22 @@ type MockServer struct {
 	srv      *gsrv.Server
 	data     map[string]Collection
 	dataLock sync.RWMutex
+	// version is incremented on every commit
+	version int64
+	// deleteTimes are the times documents were last deleted, keyed by path
+	deleteTimes map[string]time.Time
+	// resetTime is the time the data was last reset
+	resetTime time.Time
+	// indexes are the composite indexes queries are checked against, or nil
+	// if indexes aren't enforced
+	indexes []index
+
+	transactions     map[string]*transaction
+	transactionCount int64
+	transactionLock  sync.Mutex
+
+	listeners    map[*listener]bool
+	listenerLock sync.Mutex
 }
 
 func newServer() (*MockServer, error) {
@@ -48,8 +65,11 @@ func newServer() (*MockServer, error) {
 	mock := &MockServer{
 		Addr: srv.Addr,
 
-		srv:  srv,
-		data: map[string]Collection{},
+		srv:          srv,
+		data:         map[string]Collection{},
+		deleteTimes:  map[string]time.Time{},
+		transactions: map[string]*transaction{},
+		listeners:    map[*listener]bool{},
 	}
 	pb.RegisterFirestoreServer(srv.Gsrv, mock)
 	srv.Start()
@@ -60,7 +80,16 @@ func newServer() (*MockServer, error) {
 func (s *MockServer) Reset() {
 	s.dataLock.Lock()
 	s.data = map[string]Collection{}
+	s.deleteTimes = map[string]time.Time{}
+	s.resetTime = time.Now()
+	s.version++
 	s.dataLock.Unlock()
+
+	s.transactionLock.Lock()
+	s.transactions = map[string]*transaction{}
+	s.transactionLock.Unlock()
+
+	s.notifyListeners()
 }
 
 func (s *MockServer) Close() {
@@ -82,13 +111,16 @@ func (s *MockServer) LoadFromJSONFile(filePath string) error {
 
 	s.dataLock.Lock()
 	defer s.dataLock.Unlock()
+	defer s.notifyListeners()
 
+	s.version++
+	loadTime := time.Now()
 	for collectionName, collectionData := range jsonMap {
 		data, ok := collectionData.(map[string]interface{})
 		if !ok {
 			return fmt.Errorf("collection %v data is not a map: %v", collectionName, collectionData)
 		}
-		collection, err := parseCollection(collectionName, data)
+		collection, err := parseCollection(collectionName, data, s.version, loadTime)
 		if err != nil {
 			return err
 		}
@@ -98,3 +130,26 @@ func (s *MockServer) LoadFromJSONFile(filePath string) error {
 
 	return nil
 }
+
+// LoadIndexesFromJSONFile loads composite index definitions from a JSON file
+// in the firestore.indexes.json format and enables index enforcement. Once
+// enabled, queries needing a composite index that isn't defined fail with
+// codes.FailedPrecondition, as they do in Firestore.
+func (s *MockServer) LoadIndexesFromJSONFile(filePath string) error {
+	jsonBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	definitions := indexDefinitions{}
+	err = json.Unmarshal(jsonBytes, &definitions)
+	if err != nil {
+		return err
+	}
+
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+
+	s.indexes = append([]index{}, definitions.Indexes...)
+	return nil
+}
@@ -0,0 +1,100 @@
+package firestarter
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrInvalidTransaction = status.Error(codes.InvalidArgument, "transaction is invalid or expired")
+var ErrReadOnlyTransaction = status.Error(codes.InvalidArgument, "cannot modify entities in a read-only transaction")
+var ErrTransactionAborted = status.Error(codes.Aborted, "too much contention on these documents, please try again")
+
+// transaction holds the state of a transaction between BeginTransaction and
+// Commit or Rollback.
+type transaction struct {
+	id       []byte
+	readOnly bool
+	// versions of the documents read within the transaction, keyed by path
+	reads map[string]int64
+}
+
+func (s *MockServer) newTransaction(readOnly bool) *transaction {
+	s.transactionLock.Lock()
+	defer s.transactionLock.Unlock()
+
+	s.transactionCount++
+	tx := &transaction{
+		id:       []byte(fmt.Sprintf("transaction-%d", s.transactionCount)),
+		readOnly: readOnly,
+		reads:    map[string]int64{},
+	}
+	s.transactions[string(tx.id)] = tx
+	return tx
+}
+
+func (s *MockServer) getTransaction(id []byte) (*transaction, error) {
+	s.transactionLock.Lock()
+	defer s.transactionLock.Unlock()
+
+	tx, ok := s.transactions[string(id)]
+	if !ok {
+		return nil, ErrInvalidTransaction
+	}
+	return tx, nil
+}
+
+// endTransaction removes the transaction from the server. The transaction
+// can no longer be used for reads or writes after it has ended.
+func (s *MockServer) endTransaction(id []byte) (*transaction, error) {
+	s.transactionLock.Lock()
+	defer s.transactionLock.Unlock()
+
+	tx, ok := s.transactions[string(id)]
+	if !ok {
+		return nil, ErrInvalidTransaction
+	}
+	delete(s.transactions, string(id))
+	return tx, nil
+}
+
+// recordRead records the version of the document at path the first time it
+// is read within the transaction. Reads in read-only transactions aren't
+// recorded, as they never conflict. Must be called with dataLock held.
+func (s *MockServer) recordRead(tx *transaction, path string) {
+	if tx.readOnly {
+		return
+	}
+	version := s.documentVersion(path)
+
+	s.transactionLock.Lock()
+	defer s.transactionLock.Unlock()
+
+	if _, ok := tx.reads[path]; !ok {
+		tx.reads[path] = version
+	}
+}
+
+// documentVersion returns the version of the document at path or
+// missingVersion if the document doesn't exist. Must be called with dataLock
+// held.
+func (s *MockServer) documentVersion(path string) int64 {
+	doc, err := s.getDocumentByPath(path)
+	if err != nil {
+		return missingVersion
+	}
+	return doc.version
+}
+
+// checkConflicts returns ErrTransactionAborted if any document read within
+// the transaction has been modified since it was read. Must be called with
+// dataLock held.
+func (s *MockServer) checkConflicts(tx *transaction) error {
+	for path, version := range tx.reads {
+		if s.documentVersion(path) != version {
+			return ErrTransactionAborted
+		}
+	}
+	return nil
+}
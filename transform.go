@@ -0,0 +1,181 @@
+package firestarter
+
+import (
+	"math"
+	"time"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// applyTransforms applies the field transforms to the document in order and
+// returns the resulting value of each transformed field.
+func applyTransforms(doc *Document, transforms []*pb.DocumentTransform_FieldTransform, requestTime time.Time) ([]*pb.Value, error) {
+	results := []*pb.Value{}
+	for _, transform := range transforms {
+		path := parseFieldPath(transform.GetFieldPath())
+		current, _ := doc.GetPath(path)
+
+		var value interface{}
+		var err error
+		switch t := transform.GetTransformType().(type) {
+		case *pb.DocumentTransform_FieldTransform_SetToServerValue:
+			if t.SetToServerValue != pb.DocumentTransform_FieldTransform_REQUEST_TIME {
+				return nil, status.Errorf(codes.InvalidArgument, "unsupported server value: %v", t.SetToServerValue)
+			}
+			value = requestTime
+		case *pb.DocumentTransform_FieldTransform_Increment:
+			value, err = incrementValue(current, protoValueToValue(t.Increment))
+		case *pb.DocumentTransform_FieldTransform_Maximum:
+			value, err = maximumValue(current, protoValueToValue(t.Maximum))
+		case *pb.DocumentTransform_FieldTransform_Minimum:
+			value, err = minimumValue(current, protoValueToValue(t.Minimum))
+		case *pb.DocumentTransform_FieldTransform_AppendMissingElements:
+			value = appendMissingElements(current, pbArrayToSlice(t.AppendMissingElements.GetValues()))
+		case *pb.DocumentTransform_FieldTransform_RemoveAllFromArray:
+			value = removeAllFromArray(current, pbArrayToSlice(t.RemoveAllFromArray.GetValues()))
+		default:
+			err = status.Errorf(codes.InvalidArgument, "unsupported field transform: %T", t)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		doc.SetPath(path, value)
+		results = append(results, valueToProtoValue(value))
+	}
+	return results, nil
+}
+
+func isNumber(value interface{}) bool {
+	switch value.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+func numberAsFloat64(value interface{}) float64 {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+func transformOperand(operand interface{}) error {
+	if !isNumber(operand) {
+		return status.Errorf(codes.InvalidArgument, "field transform operand must be a number: %v", operand)
+	}
+	return nil
+}
+
+// incrementValue adds operand to current. Integers saturate instead of
+// overflowing and if either value is a double, the result is a double. A
+// current value that isn't a number is replaced by the operand.
+func incrementValue(current, operand interface{}) (interface{}, error) {
+	if err := transformOperand(operand); err != nil {
+		return nil, err
+	}
+	if !isNumber(current) {
+		return operand, nil
+	}
+
+	a, aok := current.(int64)
+	b, bok := operand.(int64)
+	if !aok || !bok {
+		return numberAsFloat64(current) + numberAsFloat64(operand), nil
+	}
+
+	sum := a + b
+	if a > 0 && b > 0 && sum < 0 {
+		return int64(math.MaxInt64), nil
+	}
+	if a < 0 && b < 0 && sum >= 0 {
+		return int64(math.MinInt64), nil
+	}
+	return sum, nil
+}
+
+// maximumValue returns the larger of current and operand, keeping current
+// when they are equal. The maximum of any number and NaN is NaN.
+func maximumValue(current, operand interface{}) (interface{}, error) {
+	if err := transformOperand(operand); err != nil {
+		return nil, err
+	}
+	if !isNumber(current) {
+		return operand, nil
+	}
+	if isNaN(current) {
+		return current, nil
+	}
+	if isNaN(operand) || lessThanNumber(current, operand) {
+		return operand, nil
+	}
+	return current, nil
+}
+
+// minimumValue returns the smaller of current and operand, keeping current
+// when they are equal. The minimum of any number and NaN is NaN.
+func minimumValue(current, operand interface{}) (interface{}, error) {
+	if err := transformOperand(operand); err != nil {
+		return nil, err
+	}
+	if !isNumber(current) {
+		return operand, nil
+	}
+	if isNaN(current) {
+		return current, nil
+	}
+	if isNaN(operand) || lessThanNumber(operand, current) {
+		return operand, nil
+	}
+	return current, nil
+}
+
+func isNaN(value interface{}) bool {
+	v, ok := value.(float64)
+	return ok && math.IsNaN(v)
+}
+
+func lessThanNumber(a, b interface{}) bool {
+	return compareNumbers(a, b) < 0
+}
+
+// appendMissingElements adds each element not already in the current array.
+// A current value that isn't an array is replaced.
+func appendMissingElements(current interface{}, elements []interface{}) []interface{} {
+	array, _ := current.([]interface{})
+	result := append([]interface{}{}, array...)
+	for _, element := range elements {
+		if !containsValue(result, element) {
+			result = append(result, element)
+		}
+	}
+	return result
+}
+
+// removeAllFromArray removes every instance of the elements from the current
+// array. A current value that isn't an array is replaced by an empty array.
+func removeAllFromArray(current interface{}, elements []interface{}) []interface{} {
+	array, _ := current.([]interface{})
+	result := []interface{}{}
+	for _, value := range array {
+		if !containsValue(elements, value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+func containsValue(array []interface{}, value interface{}) bool {
+	for _, v := range array {
+		if equalValues(v, value) {
+			return true
+		}
+	}
+	return false
+}
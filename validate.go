@@ -0,0 +1,228 @@
+package firestarter
+
+import (
+	"sort"
+	"strings"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxDisjunctions is the most disjunctions a query can have in disjunctive
+	// normal form, and the most values in an IN or ARRAY_CONTAINS_ANY filter
+	maxDisjunctions = 30
+	// maxNotInValues is the most values in a NOT_IN filter
+	maxNotInValues = 10
+)
+
+// validateQuery returns an InvalidArgument error for queries Firestore rejects.
+func validateQuery(squery *pb.StructuredQuery) error {
+	if squery.GetOffset() < 0 {
+		return status.Error(codes.InvalidArgument, "offset must be non-negative")
+	}
+	if squery.GetLimit() != nil && squery.GetLimit().GetValue() < 0 {
+		return status.Error(codes.InvalidArgument, "limit must be non-negative")
+	}
+
+	where := squery.GetWhere()
+	err := validateFilters(where)
+	if err != nil {
+		return err
+	}
+
+	// inequalities on multiple fields need a composite index, which is left
+	// to checkIndexes
+	inequalities := inequalityFields(where, map[string]bool{})
+	if orderBys := squery.GetOrderBy(); len(inequalities) > 0 && len(orderBys) > 0 {
+		first := orderBys[0].GetField().GetFieldPath()
+		if !inequalities[first] {
+			return status.Errorf(codes.InvalidArgument, "inequality filter property and first sort order must be the same: %s and %s", strings.Join(sortedFields(inequalities), ", "), first)
+		}
+	}
+	return nil
+}
+
+// validateFilters checks the filter values and the combinations of filters.
+func validateFilters(where *pb.StructuredQuery_Filter) error {
+	fieldFilters := []*pb.StructuredQuery_FieldFilter{}
+	hasOr := false
+	walkFilters(where, func(filter *pb.StructuredQuery_Filter) {
+		if filter.GetFieldFilter() != nil {
+			fieldFilters = append(fieldFilters, filter.GetFieldFilter())
+		}
+		if filter.GetCompositeFilter().GetOp() == pb.StructuredQuery_CompositeFilter_OR {
+			hasOr = true
+		}
+	})
+
+	ops := map[pb.StructuredQuery_FieldFilter_Operator]int{}
+	for _, filter := range fieldFilters {
+		op := filter.GetOp()
+		ops[op]++
+
+		switch op {
+		case pb.StructuredQuery_FieldFilter_IN,
+			pb.StructuredQuery_FieldFilter_NOT_IN,
+			pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS_ANY:
+			values := filter.GetValue().GetArrayValue()
+			maxValues := maxDisjunctions
+			if op == pb.StructuredQuery_FieldFilter_NOT_IN {
+				maxValues = maxNotInValues
+			}
+			if len(values.GetValues()) > maxValues {
+				return status.Errorf(codes.InvalidArgument, "'%s' supports up to %d comparison values", op, maxValues)
+			}
+		}
+	}
+
+	if ops[pb.StructuredQuery_FieldFilter_NOT_IN] > 0 {
+		switch {
+		case ops[pb.StructuredQuery_FieldFilter_NOT_IN] > 1:
+			return status.Error(codes.InvalidArgument, "a query can have at most one 'NOT_IN' filter")
+		case ops[pb.StructuredQuery_FieldFilter_NOT_EQUAL] > 0:
+			return status.Error(codes.InvalidArgument, "'NOT_IN' cannot be used in the same query with 'NOT_EQUAL'")
+		case ops[pb.StructuredQuery_FieldFilter_IN] > 0,
+			ops[pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS_ANY] > 0,
+			hasOr:
+			return status.Error(codes.InvalidArgument, "'NOT_IN' cannot be used in the same query with 'IN', 'ARRAY_CONTAINS_ANY' or 'OR'")
+		}
+	}
+
+	disjunctions := countDisjunctions(where)
+	if disjunctions > maxDisjunctions {
+		return status.Errorf(codes.InvalidArgument, "query has %d disjunctions after conversion to disjunctive normal form, the maximum is %d", disjunctions, maxDisjunctions)
+	}
+
+	for _, conjunction := range conjunctions(where) {
+		arrayContains := 0
+		arrayContainsAny := 0
+		for _, filter := range conjunction {
+			switch filter.GetFieldFilter().GetOp() {
+			case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS:
+				arrayContains++
+			case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS_ANY:
+				arrayContainsAny++
+			}
+		}
+		if arrayContains > 1 || arrayContainsAny > 1 {
+			return status.Error(codes.InvalidArgument, "a disjunction can have at most one 'ARRAY_CONTAINS' or 'ARRAY_CONTAINS_ANY' filter")
+		}
+		if arrayContains > 0 && arrayContainsAny > 0 {
+			return status.Error(codes.InvalidArgument, "'ARRAY_CONTAINS' cannot be used in the same disjunction with 'ARRAY_CONTAINS_ANY'")
+		}
+	}
+	return nil
+}
+
+// walkFilters calls fn for the filter and every filter within it.
+func walkFilters(filter *pb.StructuredQuery_Filter, fn func(*pb.StructuredQuery_Filter)) {
+	if filter == nil {
+		return
+	}
+	fn(filter)
+	for _, filter := range filter.GetCompositeFilter().GetFilters() {
+		walkFilters(filter, fn)
+	}
+}
+
+// countDisjunctions returns the number of disjunctions in the disjunctive
+// normal form of the filter, where each IN and ARRAY_CONTAINS_ANY value is a
+// disjunction.
+func countDisjunctions(filter *pb.StructuredQuery_Filter) int {
+	switch f := filter.GetFilterType().(type) {
+	case *pb.StructuredQuery_Filter_CompositeFilter:
+		count := 0
+		if f.CompositeFilter.GetOp() == pb.StructuredQuery_CompositeFilter_AND {
+			count = 1
+		}
+		for _, filter := range f.CompositeFilter.GetFilters() {
+			if f.CompositeFilter.GetOp() == pb.StructuredQuery_CompositeFilter_AND {
+				count *= countDisjunctions(filter)
+			} else {
+				count += countDisjunctions(filter)
+			}
+			if count > maxDisjunctions {
+				// stop before the count overflows
+				return count
+			}
+		}
+		return count
+	case *pb.StructuredQuery_Filter_FieldFilter:
+		switch f.FieldFilter.GetOp() {
+		case pb.StructuredQuery_FieldFilter_IN,
+			pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS_ANY:
+			return max(len(f.FieldFilter.GetValue().GetArrayValue().GetValues()), 1)
+		}
+	}
+	return 1
+}
+
+// conjunctions returns the field and unary filters of each conjunction in the
+// disjunctive normal form of the filter. IN and ARRAY_CONTAINS_ANY filters are
+// not expanded. The filter must have no more than maxDisjunctions
+// disjunctions.
+func conjunctions(filter *pb.StructuredQuery_Filter) [][]*pb.StructuredQuery_Filter {
+	switch f := filter.GetFilterType().(type) {
+	case *pb.StructuredQuery_Filter_CompositeFilter:
+		if f.CompositeFilter.GetOp() == pb.StructuredQuery_CompositeFilter_OR {
+			result := [][]*pb.StructuredQuery_Filter{}
+			for _, filter := range f.CompositeFilter.GetFilters() {
+				result = append(result, conjunctions(filter)...)
+			}
+			return result
+		}
+		// distribute the conjunction over the disjunctions of each filter
+		result := [][]*pb.StructuredQuery_Filter{{}}
+		for _, filter := range f.CompositeFilter.GetFilters() {
+			product := [][]*pb.StructuredQuery_Filter{}
+			for _, left := range result {
+				for _, right := range conjunctions(filter) {
+					product = append(product, append(append([]*pb.StructuredQuery_Filter{}, left...), right...))
+				}
+			}
+			result = product
+		}
+		return result
+	case *pb.StructuredQuery_Filter_FieldFilter, *pb.StructuredQuery_Filter_UnaryFilter:
+		return [][]*pb.StructuredQuery_Filter{{filter}}
+	}
+	return [][]*pb.StructuredQuery_Filter{{}}
+}
+
+// inequalityFields adds the fields with inequality filters to fields.
+func inequalityFields(filter *pb.StructuredQuery_Filter, fields map[string]bool) map[string]bool {
+	switch f := filter.GetFilterType().(type) {
+	case *pb.StructuredQuery_Filter_CompositeFilter:
+		for _, filter := range f.CompositeFilter.GetFilters() {
+			inequalityFields(filter, fields)
+		}
+	case *pb.StructuredQuery_Filter_FieldFilter:
+		switch f.FieldFilter.GetOp() {
+		case pb.StructuredQuery_FieldFilter_LESS_THAN,
+			pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL,
+			pb.StructuredQuery_FieldFilter_GREATER_THAN,
+			pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL,
+			pb.StructuredQuery_FieldFilter_NOT_EQUAL,
+			pb.StructuredQuery_FieldFilter_NOT_IN:
+			fields[f.FieldFilter.GetField().GetFieldPath()] = true
+		}
+	case *pb.StructuredQuery_Filter_UnaryFilter:
+		switch f.UnaryFilter.GetOp() {
+		case pb.StructuredQuery_UnaryFilter_IS_NOT_NULL,
+			pb.StructuredQuery_UnaryFilter_IS_NOT_NAN:
+			fields[f.UnaryFilter.GetField().GetFieldPath()] = true
+		}
+	}
+	return fields
+}
+
+func sortedFields(fields map[string]bool) []string {
+	sorted := []string{}
+	for field := range fields {
+		sorted = append(sorted, field)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,161 @@
+package firestarter
+
+import (
+	"math"
+	"sort"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	vectorTypeKey   = "__type__"
+	vectorTypeValue = "__vector__"
+	vectorValueKey  = "value"
+	// maxFindNearestLimit is the largest number of neighbors a query can return
+	maxFindNearestLimit = 1000
+)
+
+// Vector is a vector of doubles. Firestore encodes vectors as a map with a
+// "__type__" of "__vector__" and the elements in an array at "value".
+type Vector []float64
+
+func (v Vector) toProto() *pb.Value {
+	values := make([]*pb.Value, len(v))
+	for i, f := range v {
+		values[i] = &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: f}}
+	}
+	return &pb.Value{ValueType: &pb.Value_MapValue{MapValue: &pb.MapValue{Fields: map[string]*pb.Value{
+		vectorTypeKey:  {ValueType: &pb.Value_StringValue{StringValue: vectorTypeValue}},
+		vectorValueKey: {ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: values}}},
+	}}}}
+}
+
+// mapToVector returns the vector encoded by the map, if it is one.
+func mapToVector(m map[string]interface{}) (Vector, bool) {
+	if len(m) != 2 || m[vectorTypeKey] != vectorTypeValue {
+		return nil, false
+	}
+	values, ok := m[vectorValueKey].([]interface{})
+	if !ok {
+		return nil, false
+	}
+	vector := make(Vector, len(values))
+	for i, value := range values {
+		if !isNumber(value) {
+			return nil, false
+		}
+		vector[i] = numberAsFloat64(value)
+	}
+	return vector, true
+}
+
+func lessThanVector(a, b Vector) bool {
+	// shorter vectors are first
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// nearestDocuments returns the documents nearest to the query vector, in order
+// of distance. Documents without a vector of the same dimension in the vector
+// field are ignored.
+func nearestDocuments(docs []*Document, findNearest *pb.StructuredQuery_FindNearest) ([]*Document, error) {
+	limit := int(findNearest.GetLimit().GetValue())
+	if limit <= 0 || limit > maxFindNearestLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "find nearest limit must be between 1 and %d", maxFindNearestLimit)
+	}
+	query, ok := protoValueToValue(findNearest.GetQueryVector()).(Vector)
+	if !ok || len(query) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "find nearest query vector must be a non-empty vector")
+	}
+
+	var distance func(a, b Vector) float64
+	// ascending is whether smaller distances are nearer
+	ascending := true
+	switch findNearest.GetDistanceMeasure() {
+	case pb.StructuredQuery_FindNearest_EUCLIDEAN:
+		distance = euclideanDistance
+	case pb.StructuredQuery_FindNearest_COSINE:
+		distance = cosineDistance
+	case pb.StructuredQuery_FindNearest_DOT_PRODUCT:
+		distance = dotProduct
+		ascending = false
+	default:
+		return nil, status.Error(codes.InvalidArgument, "find nearest distance measure must be specified")
+	}
+
+	field := parseFieldPath(findNearest.GetVectorField().GetFieldPath())
+	threshold := findNearest.GetDistanceThreshold()
+
+	distances := map[*Document]float64{}
+	nearest := []*Document{}
+	for _, doc := range docs {
+		value, _ := doc.GetPath(field)
+		vector, ok := value.(Vector)
+		if !ok || len(vector) != len(query) {
+			continue
+		}
+		d := distance(vector, query)
+		if math.IsNaN(d) {
+			// cosine distance is undefined for zero vectors
+			continue
+		}
+		if threshold != nil && ((ascending && d > threshold.GetValue()) || (!ascending && d < threshold.GetValue())) {
+			continue
+		}
+		distances[doc] = d
+		nearest = append(nearest, doc)
+	}
+
+	sort.Slice(nearest, func(i, j int) bool {
+		di, dj := distances[nearest[i]], distances[nearest[j]]
+		if di != dj {
+			return (di < dj) == ascending
+		}
+		return compareNames(nearest[i].name, nearest[j].name) < 0
+	})
+	if len(nearest) > limit {
+		nearest = nearest[:limit]
+	}
+
+	if resultField := findNearest.GetDistanceResultField(); resultField != "" {
+		for i, doc := range nearest {
+			result := doc.clone()
+			result.SetPath(parseFieldPath(resultField), distances[doc])
+			nearest[i] = result
+		}
+	}
+	return nearest, nil
+}
+
+func euclideanDistance(a, b Vector) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return math.Sqrt(sum)
+}
+
+func cosineDistance(a, b Vector) float64 {
+	magnitudes := math.Sqrt(dotProduct(a, a)) * math.Sqrt(dotProduct(b, b))
+	if magnitudes == 0 {
+		return math.NaN()
+	}
+	return 1 - dotProduct(a, b)/magnitudes
+}
+
+func dotProduct(a, b Vector) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
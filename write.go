@@ -0,0 +1,190 @@
+package firestarter
+
+import (
+	"errors"
+	"time"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// writeBatch stages writes against copies of the documents they change, so
+// the data is only modified once every write in the batch has succeeded.
+type writeBatch struct {
+	s          *MockServer
+	commitTime time.Time
+	// staged copies of the written documents, keyed by path
+	documents map[string]*Document
+	// paths of the written documents, in the order they were first written
+	paths []string
+}
+
+func (s *MockServer) newWriteBatch(commitTime time.Time) *writeBatch {
+	return &writeBatch{
+		s:          s,
+		commitTime: commitTime,
+		documents:  map[string]*Document{},
+	}
+}
+
+// document returns the staged copy of the document at path, staging it first
+// if it hasn't been written yet in the batch. Must be called with dataLock
+// held.
+func (b *writeBatch) document(path string) (*Document, error) {
+	if doc, ok := b.documents[path]; ok {
+		return doc, nil
+	}
+
+	doc, err := b.s.getDocumentByPath(path)
+	if err != nil {
+		if !errors.Is(err, ErrDocumentNotFound) && !errors.Is(err, ErrCollectionNotFound) {
+			return nil, err
+		}
+		doc = &Document{
+			name:   path,
+			fields: map[string]interface{}{},
+		}
+	} else {
+		doc = doc.clone()
+	}
+
+	b.documents[path] = doc
+	b.paths = append(b.paths, path)
+	return doc, nil
+}
+
+// add stages a single write. Must be called with dataLock held.
+func (b *writeBatch) add(write *pb.Write) (*pb.WriteResult, error) {
+	switch write.GetOperation().(type) {
+	case *pb.Write_Update:
+		return b.update(write)
+	case *pb.Write_Delete:
+		return b.delete(write)
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "unsupported write operation: %T", write.GetOperation())
+}
+
+// apply applies the staged documents to the data. Must be called with dataLock
+// held.
+func (b *writeBatch) apply() {
+	for _, path := range b.paths {
+		staged := b.documents[path]
+		if !staged.exists {
+			b.s.deleteDocument(path)
+			b.s.deleteTimes[path] = b.commitTime
+			continue
+		}
+
+		// the path was validated when the document was staged
+		doc, _ := b.s.newDocumentWithPath(path)
+		doc.fields = staged.fields
+		doc.exists = true
+		doc.version = b.s.version
+		doc.createTime = staged.createTime
+		doc.updateTime = staged.updateTime
+	}
+}
+
+func (b *writeBatch) update(write *pb.Write) (*pb.WriteResult, error) {
+	path := stripPrefix(write.GetUpdate().Name)
+
+	doc, err := b.document(path)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPrecondition(doc, write.GetCurrentDocument())
+	if err != nil {
+		return nil, err
+	}
+
+	if !doc.exists {
+		doc.createTime = b.commitTime
+	}
+	doc.exists = true
+	doc.updateTime = b.commitTime
+
+	updateFields := write.GetUpdate().GetFields()
+	if write.GetUpdateMask() == nil {
+		// no updateMask, clear all fields and set new ones
+		doc.Clear()
+		for field, value := range updateFields {
+			doc.SetWithValue(field, value)
+		}
+	} else {
+		// only the fields in the updateMask are changed, and fields in the
+		// updateMask that are missing from the update are deleted
+		for _, field := range write.GetUpdateMask().GetFieldPaths() {
+			fieldPath := parseFieldPath(field)
+			pbValue := protoValueAtPath(updateFields, fieldPath)
+			if value := protoValueToValue(pbValue); value != nil || isNullValue(pbValue) {
+				doc.SetPath(fieldPath, value)
+			} else {
+				doc.DeletePath(fieldPath)
+			}
+		}
+	}
+
+	transformResults, err := applyTransforms(doc, write.GetUpdateTransforms(), b.commitTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.WriteResult{
+		UpdateTime:       timestamppb.New(doc.updateTime),
+		TransformResults: transformResults,
+	}, nil
+}
+
+func (b *writeBatch) delete(write *pb.Write) (*pb.WriteResult, error) {
+	path := stripPrefix(write.GetDelete())
+
+	doc, err := b.document(path)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPrecondition(doc, write.GetCurrentDocument())
+	if err != nil {
+		return nil, err
+	}
+
+	// deleting a missing document is a no-op
+	doc.exists = false
+	doc.Clear()
+
+	return &pb.WriteResult{UpdateTime: timestamppb.New(b.commitTime)}, nil
+}
+
+// checkPrecondition returns an error if the document doesn't meet the
+// precondition.
+func checkPrecondition(doc *Document, precondition *pb.Precondition) error {
+	switch condition := precondition.GetConditionType().(type) {
+	case *pb.Precondition_Exists:
+		if condition.Exists && !doc.exists {
+			return ErrDocumentNotFound
+		}
+		if !condition.Exists && doc.exists {
+			return ErrDocumentAlreadyExists
+		}
+	case *pb.Precondition_UpdateTime:
+		if !doc.exists || !doc.updateTime.Equal(condition.UpdateTime.AsTime()) {
+			return ErrUpdateTimeMismatch
+		}
+	}
+	return nil
+}
+
+// protoValueAtPath returns the value at the field path within fields, or nil
+// if there is no value at the path.
+func protoValueAtPath(fields map[string]*pb.Value, path []string) *pb.Value {
+	var value *pb.Value
+	for _, part := range path {
+		if fields == nil {
+			return nil
+		}
+		value = fields[part]
+		fields = value.GetMapValue().GetFields()
+	}
+	return value
+}